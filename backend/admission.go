@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Motivos de rechazo de conexiones (etiqueta reason de wsRejectedTotal)
+const (
+	rejectOrigin  = "origin"
+	rejectToken   = "token"
+	rejectIPLimit = "ip_limit"
+)
+
+// checkOrigin acepta la conexión si el origen está en Cfg.AllowedOrigins. Sin
+// lista configurada solo se acepta el mismo origen, como hace gorilla por
+// defecto; "*" acepta cualquiera. Las peticiones sin cabecera Origin (clientes
+// que no son navegadores) se aceptan siempre.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || originAllowed(origin, r.Host) {
+		return true
+	}
+	wsRejectedTotal.WithLabelValues(rejectOrigin).Inc()
+	log.Println("Conexión rechazada por origen:", origin)
+	return false
+}
+
+// originAllowed indica si origin está en Cfg.AllowedOrigins o, si no hay
+// lista, si es el mismo origen que host (la cabecera Host de la petición).
+func originAllowed(origin, host string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if len(Cfg.AllowedOrigins) == 0 {
+		return strings.EqualFold(u.Host, host)
+	}
+	origin = strings.ToLower(u.Scheme + "://" + u.Host)
+	for _, allowed := range Cfg.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// validJoinToken comprueba el token de acceso cuando hay Cfg.JoinSecret.
+// Se acepta el propio secreto o un token firmado "<expira>.<firma>", donde
+// expira es un timestamp Unix y firma el HMAC-SHA256 en hex de expira.
+func validJoinToken(token string) bool {
+	if Cfg.JoinSecret == "" {
+		return true
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(Cfg.JoinSecret)) == 1 {
+		return true
+	}
+
+	expires, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return false
+	}
+	want := joinTokenSignature(Cfg.JoinSecret, expires)
+	return subtle.ConstantTimeCompare([]byte(sig), []byte(want)) == 1
+}
+
+// signJoinToken genera un token de acceso válido hasta expires.
+func signJoinToken(secret string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + joinTokenSignature(secret, exp)
+}
+
+func joinTokenSignature(secret, expires string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// clientIP devuelve la IP del cliente. Con Cfg.TrustProxyHeaders (cuando el
+// servidor está detrás de un proxy) se usa la última dirección de
+// X-Forwarded-For, la que añade el proxy: las anteriores las pone el cliente y
+// se pueden falsificar.
+func clientIP(r *http.Request) string {
+	if Cfg.TrustProxyHeaders {
+		fwd := strings.Join(r.Header.Values("X-Forwarded-For"), ",")
+		entries := strings.Split(fwd, ",")
+		for i := len(entries) - 1; i >= 0; i-- {
+			if ip := strings.TrimSpace(entries[i]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ipConnLimiter cuenta las conexiones WebSocket abiertas por IP.
+type ipConnLimiter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// acquire reserva una conexión para ip. Devuelve false si ya tiene
+// Cfg.MaxConnsPerIP abiertas (0 = sin límite).
+func (l *ipConnLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if Cfg.MaxConnsPerIP > 0 && l.counts[ip] >= Cfg.MaxConnsPerIP {
+		return false
+	}
+	if l.counts == nil {
+		l.counts = make(map[string]int)
+	}
+	l.counts[ip]++
+	return true
+}
+
+func (l *ipConnLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[ip] <= 1 {
+		delete(l.counts, ip)
+		return
+	}
+	l.counts[ip]--
+}
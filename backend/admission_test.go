@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestValidJoinToken(t *testing.T) {
+	defer func(old string) { Cfg.JoinSecret = old }(Cfg.JoinSecret)
+	Cfg.JoinSecret = "s3cret"
+	now := time.Now()
+	cases := []struct {
+		name  string
+		token string
+		want  bool
+	}{
+		{"secreto", "s3cret", true},
+		{"firmado", signJoinToken("s3cret", now.Add(time.Minute)), true},
+		{"caducado", signJoinToken("s3cret", now.Add(-time.Minute)), false},
+		{"otro secreto", signJoinToken("otro", now.Add(time.Minute)), false},
+		{"firma alterada", signJoinToken("s3cret", now.Add(time.Minute)) + "0", false},
+		{"sin firma", "12345", false},
+		{"expiración no numérica", "abc." + joinTokenSignature("s3cret", "abc"), false},
+		{"vacío", "", false},
+	}
+	for _, tc := range cases {
+		if got := validJoinToken(tc.token); got != tc.want {
+			t.Errorf("%s: validJoinToken(%q) = %v, se esperaba %v", tc.name, tc.token, got, tc.want)
+		}
+	}
+
+	Cfg.JoinSecret = ""
+	if !validJoinToken("") {
+		t.Error("sin JoinSecret cualquier token debería valer")
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	defer func(old []string) { Cfg.AllowedOrigins = old }(Cfg.AllowedOrigins)
+	cases := []struct {
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		// Sin lista solo se admite el mismo origen
+		{nil, "https://farkle.example", true},
+		{nil, "https://Farkle.Example", true},
+		{nil, "https://evil.example", false},
+		{nil, "https://farkle.example:8443", false},
+		{[]string{"https://farkle.example"}, "https://farkle.example", true},
+		{[]string{"https://farkle.example"}, "HTTPS://Farkle.Example", true},
+		{[]string{"https://farkle.example"}, "https://farkle.example/ruta", true},
+		{[]string{"https://farkle.example"}, "http://farkle.example", false},
+		{[]string{"https://farkle.example"}, "https://farkle.example:8443", false},
+		{[]string{"https://farkle.example"}, "https://farkle.example.evil", false},
+		{[]string{"https://farkle.example"}, "::no es una url", false},
+		{[]string{"*"}, "https://cualquiera.example", true},
+	}
+	for _, tc := range cases {
+		Cfg.AllowedOrigins = tc.allowed
+		if got := originAllowed(tc.origin, "farkle.example"); got != tc.want {
+			t.Errorf("originAllowed(%q) con %v = %v, se esperaba %v", tc.origin, tc.allowed, got, tc.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(old bool) { Cfg.TrustProxyHeaders = old }(Cfg.TrustProxyHeaders)
+	cases := []struct {
+		trust bool
+		fwd   []string
+		want  string
+	}{
+		{false, []string{"1.1.1.1"}, "10.0.0.9"},
+		{true, nil, "10.0.0.9"},
+		{true, []string{"1.1.1.1"}, "1.1.1.1"},
+		// Las primeras direcciones las pone el cliente: se usa la que añade el proxy
+		{true, []string{"6.6.6.6, 1.1.1.1"}, "1.1.1.1"},
+		{true, []string{"6.6.6.6", "1.1.1.1 "}, "1.1.1.1"},
+		{true, []string{"1.1.1.1,"}, "1.1.1.1"},
+	}
+	for _, tc := range cases {
+		Cfg.TrustProxyHeaders = tc.trust
+		r := &http.Request{RemoteAddr: "10.0.0.9:5555", Header: http.Header{}}
+		for _, v := range tc.fwd {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(r); got != tc.want {
+			t.Errorf("clientIP con trust=%v y %q = %s, se esperaba %s", tc.trust, tc.fwd, got, tc.want)
+		}
+	}
+}
+
+func TestListGamesAppliesAdmission(t *testing.T) {
+	defer func(old string) { Cfg.JoinSecret = old }(Cfg.JoinSecret)
+	defer func(old rateLimit) { Cfg.ListGamesRatePerIP = old }(Cfg.ListGamesRatePerIP)
+	Cfg.JoinSecret = "s3cret"
+	Cfg.ListGamesRatePerIP = rateLimit{Rate: 0.001, Burst: 2}
+	h := startTestHub(t)
+
+	get := func(target string) int {
+		w := httptest.NewRecorder()
+		handleListGames(h, w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w.Code
+	}
+	if code := get("/games"); code != http.StatusForbidden {
+		t.Fatalf("sin token: %d, se esperaba 403", code)
+	}
+	for i := 0; i < Cfg.ListGamesRatePerIP.Burst; i++ {
+		if code := get("/games?token=s3cret"); code != http.StatusOK {
+			t.Fatalf("consulta %d con token: %d, se esperaba 200", i, code)
+		}
+	}
+	if code := get("/games?token=s3cret"); code != http.StatusTooManyRequests {
+		t.Fatalf("tras agotar la ráfaga: %d, se esperaba 429", code)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import "time"
+
+// isAFK indica si el jugador del asiento i está ausente: nextActivePlayerIndex
+// se salta su turno hasta que vuelva.
+func (g *Game) isAFK(i int) bool {
+	return !g.afkSince[i].IsZero()
+}
+
+// recordTimeout cuenta un turno vencido del jugador y lo marca como ausente
+// al llegar a Cfg.AfkTimeouts turnos vencidos seguidos.
+func (g *Game) recordTimeout(seat int) {
+	g.timeouts[seat]++
+	if Cfg.AfkTimeouts <= 0 || g.timeouts[seat] < Cfg.AfkTimeouts || g.isAFK(seat) {
+		return
+	}
+
+	since := time.Now()
+	g.afkSince[seat] = since
+	g.broadcast(map[string]any{
+		jsonKeyType:   msgPlayerAFK,
+		jsonKeyMsg:    g.playerNames[seat] + " está ausente",
+		"playerIndex": seat,
+	})
+
+	// Si sigue ausente pasado Cfg.AfkRemoveAfter, se libera su asiento. Un
+	// afkSince distinto significa que volvió (y quizá se ausentó de nuevo).
+	if Cfg.AfkRemoveAfter > 0 {
+		time.AfterFunc(Cfg.AfkRemoveAfter, func() {
+			g.do(func() {
+				if g.afkSince[seat].Equal(since) {
+					g.removeAFK(seat)
+				}
+			})
+		})
+	}
+}
+
+// clearAFK olvida los turnos vencidos del jugador y, si estaba ausente, avisa
+// de que ha vuelto.
+func (g *Game) clearAFK(seat int) {
+	g.timeouts[seat] = 0
+	if !g.isAFK(seat) {
+		return
+	}
+	g.afkSince[seat] = time.Time{}
+	g.broadcast(map[string]any{
+		jsonKeyType:   msgPlayerReturned,
+		jsonKeyMsg:    g.playerNames[seat] + " ha vuelto",
+		"playerIndex": seat,
+	})
+}
+
+// resetAFK olvida los turnos vencidos y las ausencias de todos los jugadores
+// al reiniciar la partida. Las retiradas pendientes se descartan solas porque
+// afkSince ya no coincide.
+func (g *Game) resetAFK() {
+	for i := range g.timeouts {
+		g.timeouts[i] = 0
+		g.afkSince[i] = time.Time{}
+	}
+}
+
+// removeAFK libera el asiento de un jugador que lleva demasiado tiempo
+// ausente. Sigue conectado, pero sin partida, como tras una expulsión.
+func (g *Game) removeAFK(seat int) {
+	target := g.clients[seat]
+	if target == nil {
+		return
+	}
+	target.game.CompareAndSwap(g, nil)
+	target.sendJSON(map[string]any{
+		jsonKeyType:     msgRemovedAFK,
+		jsonKeyGameCode: g.code,
+	})
+
+	g.resumeTokens[seat] = ""
+	g.removePlayer(seat, msgPlayerRemovedAFK)
+}
+
+// handleBack marca que el jugador vuelve a estar presente.
+func (g *Game) handleBack(c *Client) {
+	seat := g.seatOf(c)
+	if seat < 0 {
+		g.sendNotSeated(c)
+		return
+	}
+	wasAFK := g.isAFK(seat)
+	g.clearAFK(seat)
+	if wasAFK {
+		g.broadcastState()
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Canales de chat: el de la mesa lo ven jugadores y espectadores; el de los
+// espectadores, solo ellos (para que no puedan influir en la partida).
+const (
+	chatChannelTable      = "table"
+	chatChannelSpectators = "spectators"
+)
+
+// ChatFilter decide qué se publica de un mensaje de chat. Devuelve el texto a
+// publicar (p. ej. con palabras censuradas) o false para descartarlo.
+type ChatFilter interface {
+	Filter(text string) (string, bool)
+}
+
+// wordListFilter censura con asteriscos las palabras de una lista, sin
+// distinguir mayúsculas.
+type wordListFilter struct {
+	words map[string]bool
+}
+
+func newWordListFilter(words []string) *wordListFilter {
+	f := &wordListFilter{words: make(map[string]bool, len(words))}
+	for _, w := range words {
+		f.words[strings.ToLower(w)] = true
+	}
+	return f
+}
+
+func (f *wordListFilter) Filter(text string) (string, bool) {
+	if len(f.words) == 0 {
+		return text, true
+	}
+	var b strings.Builder
+	word := []rune{}
+	flush := func() {
+		if f.words[strings.ToLower(string(word))] {
+			b.WriteString(strings.Repeat("*", len(word)))
+		} else {
+			b.WriteString(string(word))
+		}
+		word = word[:0]
+	}
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			word = append(word, r)
+			continue
+		}
+		flush()
+		b.WriteRune(r)
+	}
+	flush()
+	return b.String(), true
+}
+
+// chatLine es un mensaje de chat ya publicado.
+type chatLine struct {
+	Channel     string `json:"channel"`
+	PlayerIndex int    `json:"playerIndex"` // -1 para los espectadores
+	Name        string `json:"name"`
+	Text        string `json:"text"`
+	At          int64  `json:"at"` // Unix en milisegundos
+}
+
+// handleChat publica un mensaje de chat de un jugador (en la mesa) o de un
+// espectador (en el canal de espectadores).
+func (g *Game) handleChat(c *Client, msg InMessage) {
+	seat := g.seatOf(c)
+	if seat < 0 && !g.spectators[c] {
+		c.sendError(errNoGame)
+		return
+	}
+
+	text := strings.TrimSpace(msg.Text)
+	if text == "" || utf8.RuneCountInString(text) > Cfg.ChatMaxLength {
+		c.sendError(errInvalidChat)
+		return
+	}
+	text, ok := g.hub.chatFilter.Filter(text)
+	if !ok {
+		c.sendError(errChatRejected)
+		return
+	}
+
+	line := chatLine{
+		Channel:     chatChannelTable,
+		PlayerIndex: seat,
+		Name:        "Espectador",
+		Text:        text,
+		At:          time.Now().UnixMilli(),
+	}
+	if seat >= 0 {
+		line.Name = g.playerNames[seat]
+	} else {
+		line.Channel = chatChannelSpectators
+	}
+	g.chatHistory = append(g.chatHistory, line)
+	if over := len(g.chatHistory) - Cfg.ChatHistorySize; over > 0 {
+		g.chatHistory = append(g.chatHistory[:0], g.chatHistory[over:]...)
+	}
+
+	payload := map[string]any{jsonKeyType: msgChat, "line": line}
+	if line.Channel == chatChannelTable {
+		for _, other := range g.clients {
+			if other != nil && !g.muted(other, seat) {
+				other.sendJSON(payload)
+			}
+		}
+	}
+	for other := range g.spectators {
+		other.sendJSON(payload)
+	}
+}
+
+// handleMute silencia (o deja de silenciar) para el cliente el chat del
+// jugador del asiento msg.Index.
+func (g *Game) handleMute(c *Client, msg InMessage, mute bool) {
+	seat := g.seatOf(c)
+	if seat < 0 {
+		g.sendNotSeated(c)
+		return
+	}
+	if msg.Index < 0 || msg.Index >= len(g.clients) || msg.Index == seat {
+		c.sendError(errInvalidIndex)
+		return
+	}
+	if !mute {
+		delete(g.mutes[c], msg.Index)
+		return
+	}
+	if g.mutes[c] == nil {
+		g.mutes[c] = make(map[int]bool)
+	}
+	g.mutes[c][msg.Index] = true
+}
+
+// muted indica si c ha silenciado el chat del asiento seat.
+func (g *Game) muted(c *Client, seat int) bool {
+	return g.mutes[c][seat]
+}
+
+// sendChatHistory envía al cliente que entra (o vuelve) a la partida las
+// últimas líneas de chat que puede ver.
+func (g *Game) sendChatHistory(c *Client) {
+	spectator := g.spectators[c]
+	lines := make([]chatLine, 0, len(g.chatHistory))
+	for _, line := range g.chatHistory {
+		if line.Channel == chatChannelTable || spectator {
+			lines = append(lines, line)
+		}
+	}
+	c.sendJSON(map[string]any{jsonKeyType: msgChatHistory, "lines": lines})
+}
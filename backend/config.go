@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -24,6 +25,33 @@ type Config struct {
 	MaxVictoryScore       int
 	FinishedGameRetention time.Duration
 	CleanupInterval       time.Duration
+	StateHistorySize      int
+	RequestCacheSize      int
+	SlowClientTimeout     time.Duration
+	PingInterval          time.Duration
+	PongWait              time.Duration
+	WriteWait             time.Duration
+	MaxMessageSize        int64
+	AllowedOrigins        []string
+	JoinSecret            string
+	MaxConnsPerIP         int
+	TrustProxyHeaders     bool
+	MessageRateLimits     map[string]rateLimit
+	CreateRatePerIP       rateLimit
+	ListGamesRatePerIP    rateLimit
+	QueueTimeout          time.Duration
+	JoinPasswordAttempts  int
+	JoinPasswordLockout   time.Duration
+	JoinMissRate          rateLimit
+	MinPlayers            int
+	ChatMaxLength         int
+	ChatHistorySize       int
+	ChatBannedWords       []string
+	EventLogSize          int
+	TurnTimeLimit         time.Duration
+	ChessClock            time.Duration
+	AfkTimeouts           int
+	AfkRemoveAfter        time.Duration
 }
 
 func init() {
@@ -37,6 +65,27 @@ func init() {
 		numPlayers = 10
 	}
 
+	minPlayers := getEnvInt("FARKLE_MIN_PLAYERS", 2)
+	if minPlayers < 2 {
+		minPlayers = 2
+	}
+	if minPlayers > numPlayers {
+		minPlayers = numPlayers
+	}
+
+	stateHistorySize := getEnvInt("FARKLE_STATE_HISTORY_SIZE", 32)
+	if stateHistorySize < 1 {
+		stateHistorySize = 1
+	}
+
+	// El ping debe enviarse antes de que venza la espera del pong
+	pongWait := getEnvDuration("FARKLE_PONG_WAIT", 60*time.Second)
+	pingInterval := getEnvDuration("FARKLE_PING_INTERVAL", 54*time.Second)
+	if pingInterval <= 0 || pingInterval >= pongWait {
+		pingInterval = pongWait * 9 / 10
+		log.Printf("config: FARKLE_PING_INTERVAL debe ser menor que FARKLE_PONG_WAIT, usando %v", pingInterval)
+	}
+
 	Cfg = &Config{
 		Port:                  getEnv("FARKLE_PORT", "8080"),
 		SendBufferSize:        getEnvInt("FARKLE_SEND_BUFFER_SIZE", 256),
@@ -49,6 +98,33 @@ func init() {
 		MaxVictoryScore:       getEnvInt("FARKLE_MAX_VICTORY_SCORE", 100000),
 		FinishedGameRetention: getEnvDuration("FARKLE_FINISHED_GAME_RETENTION", 5*time.Minute),
 		CleanupInterval:       getEnvDuration("FARKLE_CLEANUP_INTERVAL", 1*time.Minute),
+		StateHistorySize:      stateHistorySize,
+		RequestCacheSize:      getEnvInt("FARKLE_REQUEST_CACHE_SIZE", 64),
+		SlowClientTimeout:     getEnvDuration("FARKLE_SLOW_CLIENT_TIMEOUT", 10*time.Second),
+		PingInterval:          pingInterval,
+		PongWait:              pongWait,
+		WriteWait:             getEnvDuration("FARKLE_WRITE_WAIT", 10*time.Second),
+		MaxMessageSize:        int64(getEnvInt("FARKLE_MAX_MESSAGE_SIZE", 4096)),
+		AllowedOrigins:        getEnvList("FARKLE_ALLOWED_ORIGINS"),
+		JoinSecret:            getEnv("FARKLE_JOIN_SECRET", ""),
+		MaxConnsPerIP:         getEnvInt("FARKLE_MAX_CONNS_PER_IP", 20),
+		TrustProxyHeaders:     getEnvBool("FARKLE_TRUST_PROXY_HEADERS", false),
+		MessageRateLimits:     getEnvRateLimits("FARKLE_RATE_LIMITS", defaultMessageRateLimits()),
+		CreateRatePerIP:       getEnvRateLimit("FARKLE_CREATE_RATE_PER_IP", rateLimit{Rate: 0.1, Burst: 5}),
+		ListGamesRatePerIP:    getEnvRateLimit("FARKLE_LIST_GAMES_RATE_PER_IP", rateLimit{Rate: 1, Burst: 10}),
+		QueueTimeout:          getEnvDuration("FARKLE_QUEUE_TIMEOUT", 2*time.Minute),
+		JoinPasswordAttempts:  getEnvInt("FARKLE_JOIN_PASSWORD_ATTEMPTS", 5),
+		JoinPasswordLockout:   getEnvDuration("FARKLE_JOIN_PASSWORD_LOCKOUT", 5*time.Minute),
+		JoinMissRate:          getEnvRateLimit("FARKLE_JOIN_MISS_RATE", rateLimit{Rate: 0.1, Burst: 5}),
+		MinPlayers:            minPlayers,
+		ChatMaxLength:         getEnvInt("FARKLE_CHAT_MAX_LENGTH", 200),
+		ChatHistorySize:       getEnvInt("FARKLE_CHAT_HISTORY_SIZE", 20),
+		ChatBannedWords:       getEnvList("FARKLE_CHAT_BANNED_WORDS"),
+		EventLogSize:          getEnvInt("FARKLE_EVENT_LOG_SIZE", 2000),
+		TurnTimeLimit:         getEnvDuration("FARKLE_TURN_TIME_LIMIT", 0),
+		ChessClock:            getEnvDuration("FARKLE_CHESS_CLOCK", 0),
+		AfkTimeouts:           getEnvInt("FARKLE_AFK_TIMEOUTS", 2),
+		AfkRemoveAfter:        getEnvDuration("FARKLE_AFK_REMOVE_AFTER", 5*time.Minute),
 	}
 }
 
@@ -82,3 +158,75 @@ func getEnvDuration(key string, defaultVal time.Duration) time.Duration {
 	}
 	return defaultVal
 }
+
+func getEnvBool(key string, defaultVal bool) bool {
+	if v := os.Getenv(key); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Printf("config: %s inválido (%q), usando %v", key, v, defaultVal)
+			return defaultVal
+		}
+		return b
+	}
+	return defaultVal
+}
+
+// getEnvList lee una lista separada por comas, sin espacios ni elementos vacíos
+// y en minúsculas.
+func getEnvList(key string) []string {
+	var out []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		item = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(item), "/"))
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// defaultMessageRateLimits son los límites por tipo de mensaje y conexión si no
+// se configuran con FARKLE_RATE_LIMITS.
+func defaultMessageRateLimits() map[string]rateLimit {
+	return map[string]rateLimit{
+		rateLimitDefault: {Rate: 10, Burst: 20},
+		msgToggleSelect:  {Rate: 8, Burst: 12},
+		msgCreate:        {Rate: 0.2, Burst: 3},
+		msgJoin:          {Rate: 1, Burst: 5},
+		msgChat:          {Rate: 1, Burst: 5},
+		msgReact:         {Rate: 0.5, Burst: 3},
+		// Se confirma cada game_state, y con la mesa llena llegan muchos por
+		// segundo: los acks no deben gastar los tokens de las jugadas
+		msgStateAck: {Rate: 100, Burst: 200},
+	}
+}
+
+func getEnvRateLimit(key string, defaultVal rateLimit) rateLimit {
+	if v := os.Getenv(key); v != "" {
+		limit, err := parseRateLimit(v)
+		if err != nil {
+			log.Printf("config: %s inválido (%q: %v), usando %v/%d", key, v, err, defaultVal.Rate, defaultVal.Burst)
+			return defaultVal
+		}
+		return limit
+	}
+	return defaultVal
+}
+
+// getEnvRateLimits lee una lista "tipo=rate/burst,..." que sobrescribe los
+// límites por defecto de los tipos indicados.
+func getEnvRateLimits(key string, defaults map[string]rateLimit) map[string]rateLimit {
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		msgType, spec, ok := strings.Cut(item, "=")
+		limit, err := parseRateLimit(spec)
+		if !ok || err != nil {
+			log.Printf("config: %s contiene un límite inválido (%q), se ignora", key, item)
+			continue
+		}
+		defaults[strings.TrimSpace(msgType)] = limit
+	}
+	return defaults
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+)
+
+// maxRequestIDLength limita el tamaño de los requestId que guarda la caché
+// de respuestas de cada conexión.
+const maxRequestIDLength = 64
+
+// withSeq devuelve una copia del objeto JSON data con el campo seq añadido al
+// principio. Los mensajes que no son objetos se devuelven sin cambios.
+func withSeq(data []byte, seq uint64) []byte {
+	if len(data) < 2 || data[0] != '{' {
+		return data
+	}
+	out := make([]byte, 0, len(data)+24)
+	out = append(out, `{"`+jsonKeySeq+`":`...)
+	out = strconv.AppendUint(out, seq, 10)
+	if len(data) > 2 {
+		out = append(out, ',')
+	}
+	return append(out, data[1:]...)
+}
+
+// requestCache guarda las últimas respuestas (ack o error) enviadas por una
+// conexión, indexadas por requestId, para responder a reintentos sin volver a
+// ejecutar la acción. Solo la usa la goroutine de readPump. Al desconectarse un
+// jugador, la partida guarda la caché de su asiento y se la pasa a la conexión
+// que lo recupera con resumeToken, así que un reintento tras reconectar
+// tampoco repite la acción.
+type requestCache struct {
+	replies map[string][]byte
+	order   []string
+}
+
+func (rc *requestCache) get(id string) ([]byte, bool) {
+	reply, ok := rc.replies[id]
+	return reply, ok
+}
+
+func (rc *requestCache) put(id string, reply []byte) {
+	if rc.replies == nil {
+		rc.replies = make(map[string][]byte)
+	}
+	if _, ok := rc.replies[id]; !ok {
+		rc.order = append(rc.order, id)
+	}
+	rc.replies[id] = reply
+	for len(rc.order) > Cfg.RequestCacheSize {
+		delete(rc.replies, rc.order[0])
+		rc.order = rc.order[1:]
+	}
+}
+
+// merge añade a rc las respuestas de other que no tiene, de la más antigua a
+// la más reciente.
+func (rc *requestCache) merge(other requestCache) {
+	for _, id := range other.order {
+		if _, ok := rc.replies[id]; !ok {
+			rc.put(id, other.replies[id])
+		}
+	}
+}
+
+// handleRequest procesa un mensaje con requestId. Si el requestId ya se ha
+// procesado en esta conexión (o en la que tenía el asiento recuperado), se
+// reenvía la respuesta guardada sin repetir la acción; si no, se ejecuta y se
+// responde con el primer error producido o con un ack correlacionado.
+func (c *Client) handleRequest(msg InMessage) {
+	if len(msg.RequestID) > maxRequestIDLength {
+		c.sendError(errInvalidRequestID)
+		return
+	}
+	if reply, ok := c.requests.get(msg.RequestID); ok {
+		c.sendRaw(reply)
+		return
+	}
+
+	c.requestID = msg.RequestID
+	c.requestReply = nil
+	c.rateLimited = false
+	c.handleMessage(msg)
+	reply, rateLimited := c.requestReply, c.rateLimited
+	c.requestID = ""
+	c.requestReply = nil
+	c.rateLimited = false
+
+	// Un mensaje frenado por los límites ya tiene su respuesta RATE_LIMITED y
+	// no se guarda: el reintento se procesará cuando haya intentos
+	if rateLimited {
+		return
+	}
+	if reply == nil {
+		data, err := json.Marshal(map[string]string{jsonKeyType: msgAck, jsonKeyRequest: msg.RequestID})
+		if err != nil {
+			return
+		}
+		reply = data
+		c.sendRaw(reply)
+	}
+	c.requests.put(msg.RequestID, reply)
+}
+
+// handleResync responde a un cliente que ha detectado un hueco en los números
+// de secuencia: le reenvía su partida y asiento actuales y, si está en una
+// partida, el estado completo.
+func (c *Client) handleResync() {
+	g := c.game.Load()
+	if g == nil || !g.call(func() { g.handleResync(c) }) {
+		c.sendResynced("", invalidIndex)
+	}
+}
+
+func (g *Game) handleResync(c *Client) {
+	seat := g.seatOf(c)
+	if seat < 0 && !g.spectators[c] {
+		c.sendResynced("", invalidIndex)
+		return
+	}
+	c.sendResynced(g.code, seat)
+	g.handleGetState(c)
+	g.sendChatHistory(c)
+}
+
+func (c *Client) sendResynced(gameCode string, playerIndex int) {
+	c.sendJSON(map[string]any{
+		jsonKeyType:     msgResynced,
+		jsonKeyGameCode: gameCode,
+		"playerIndex":   playerIndex,
+	})
+}
+
+// enqueue encola un mensaje ya serializado añadiéndole el siguiente número de
+// secuencia de la conexión. Si el canal está lleno, los game_state se coalescen
+// en pendingState y el resto se pierde (su número de secuencia queda consumido
+// para que el cliente detecte el hueco y pida resync). Si la conexión sigue
+// saturada más de Cfg.SlowClientTimeout, se cierra.
+func (c *Client) enqueue(data []byte, coalesce bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+
+	if coalesce && (c.pendingState != nil || len(c.send) == cap(c.send)) {
+		if c.pendingState != nil {
+			outboundBackpressureTotal.WithLabelValues(backpressureCoalesced).Inc()
+		}
+		c.pendingState = data
+		select {
+		case c.stateReady <- struct{}{}:
+		default:
+		}
+		c.markSaturatedLocked()
+		return
+	}
+
+	c.seq++
+	select {
+	case c.send <- withSeq(data, c.seq):
+	default:
+		outboundBackpressureTotal.WithLabelValues(backpressureDropped).Inc()
+		log.Println("Canal lleno, no se pudo enviar")
+		c.markSaturatedLocked()
+	}
+}
+
+// markSaturatedLocked registra que la cola de envío está llena y desconecta al
+// cliente si lleva así más de Cfg.SlowClientTimeout. Debe llamarse con c.mu
+// bloqueado.
+func (c *Client) markSaturatedLocked() {
+	now := time.Now()
+	if c.saturatedSince.IsZero() {
+		c.saturatedSince = now
+		return
+	}
+	if now.Sub(c.saturatedSince) < Cfg.SlowClientTimeout {
+		return
+	}
+	outboundBackpressureTotal.WithLabelValues(backpressureDisconnected).Inc()
+	log.Printf("Cliente saturado durante más de %v, cerrando conexión", Cfg.SlowClientTimeout)
+	c.saturatedSince = time.Time{}
+	// Cerrar la conexión hace fallar readPump, que pasa por Hub.unregister
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// takePendingState devuelve el game_state coalescido, ya numerado, si la cola de
+// envío está vacía. Al vaciarse la cola la conexión deja de estar saturada.
+func (c *Client) takePendingState() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.send) > 0 {
+		return nil
+	}
+	c.saturatedSince = time.Time{}
+	if c.pendingState == nil {
+		return nil
+	}
+	c.seq++
+	data := withSeq(c.pendingState, c.seq)
+	c.pendingState = nil
+	return data
+}
+
+// closeSend cierra el canal de envío; los mensajes posteriores se descartan.
+func (c *Client) closeSend() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.send)
+}
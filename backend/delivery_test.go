@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+// newRecordingClient es como newTestClient, pero guarda lo que se le envía
+// para leerlo con received.
+func newRecordingClient(h *Hub, ip string) *Client {
+	c := &Client{
+		hub:        h,
+		ip:         ip,
+		send:       make(chan []byte, Cfg.SendBufferSize),
+		stateReady: make(chan struct{}, 1),
+	}
+	h.register <- c
+	return c
+}
+
+// received devuelve los mensajes encolados para c desde la última llamada.
+func received(t *testing.T, c *Client) []map[string]any {
+	t.Helper()
+	var out []map[string]any
+	for {
+		select {
+		case data := <-c.send:
+			var msg map[string]any
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatalf("mensaje no válido %q: %v", data, err)
+			}
+			out = append(out, msg)
+		default:
+			return out
+		}
+	}
+}
+
+// lastOfType devuelve el último mensaje de msgs con el tipo indicado, o nil.
+func lastOfType(msgs []map[string]any, msgType string) map[string]any {
+	var found map[string]any
+	for _, msg := range msgs {
+		if msg[jsonKeyType] == msgType {
+			found = msg
+		}
+	}
+	return found
+}
+
+func TestWithSeq(t *testing.T) {
+	cases := []struct {
+		in   string
+		seq  uint64
+		want string
+	}{
+		{`{"type":"ack"}`, 7, `{"seq":7,"type":"ack"}`},
+		{`{}`, 1, `{"seq":1}`},
+		{`[1,2]`, 3, `[1,2]`},
+		{`"x"`, 3, `"x"`},
+		{``, 3, ``},
+	}
+	for _, tc := range cases {
+		if got := string(withSeq([]byte(tc.in), tc.seq)); got != tc.want {
+			t.Errorf("withSeq(%s, %d) = %s, se esperaba %s", tc.in, tc.seq, got, tc.want)
+		}
+	}
+}
+
+func TestRequestReplyIsResentWithoutRepeatingTheAction(t *testing.T) {
+	h := startTestHub(t)
+	c := newRecordingClient(h, "10.17.0.1")
+
+	c.handleRequest(InMessage{Type: msgPing, RequestID: "p1"})
+	first := received(t, c)
+	if lastOfType(first, msgPong) == nil || lastOfType(first, msgAck) == nil {
+		t.Fatalf("se esperaba pong y ack, llegó %v", first)
+	}
+
+	c.handleRequest(InMessage{Type: msgPing, RequestID: "p1"})
+	again := received(t, c)
+	if len(again) != 1 || again[0][jsonKeyType] != msgAck || again[0][jsonKeyRequest] != "p1" {
+		t.Fatalf("el reintento debería reenviar solo el ack, llegó %v", again)
+	}
+}
+
+func TestRequestCacheSurvivesResume(t *testing.T) {
+	h := startTestHub(t)
+	g, players := startTestGame(t, h, InMessage{MaxPlayers: 3}, "10.17.1.1", "10.17.1.2", "10.17.1.3")
+	guest := players[1]
+
+	// El invitado se planta con requestId y se desconecta antes de ver el ack
+	var token string
+	g.call(func() {
+		g.currentPlayerIndex = 1
+		g.turnPoints = 300
+		g.hasApartadoThisRoll = true
+		token = g.resumeTokens[1]
+	})
+	guest.handleRequest(InMessage{Type: msgBank, RequestID: "b1"})
+	h.unregister <- guest
+	waitFor(t, "que se libere el asiento", func() bool {
+		free := false
+		g.call(func() { free = g.clients[1] == nil })
+		return free
+	})
+
+	back := newRecordingClient(h, "10.17.1.2")
+	back.handleJoin(InMessage{Type: msgJoin, GameCode: g.code, ResumeToken: token})
+	received(t, back)
+	back.handleRequest(InMessage{Type: msgBank, RequestID: "b1"})
+	msgs := received(t, back)
+	if ack := lastOfType(msgs, msgAck); ack == nil || ack[jsonKeyRequest] != "b1" {
+		t.Fatalf("el reintento tras reanudar debería recibir el ack guardado, llegó %v", msgs)
+	}
+	if lastOfType(msgs, msgError) != nil {
+		t.Fatalf("el reintento se ha vuelto a ejecutar: %v", msgs)
+	}
+	g.call(func() {
+		if g.totals[1] != 300 {
+			t.Errorf("total del invitado = %d, se esperaba 300", g.totals[1])
+		}
+	})
+}
+
+func TestRateLimitedRequestIsNotAckedOrCached(t *testing.T) {
+	h := startTestHub(t)
+	host := newTestClient(h, "10.17.2.1")
+	host.handleCreate(InMessage{Type: msgCreate})
+	code := host.game.Load().code
+
+	prober := newRecordingClient(h, "10.17.2.2")
+	for i := 0; i < Cfg.JoinMissRate.Burst; i++ {
+		prober.handleJoin(InMessage{Type: msgJoin, GameCode: "-" + strconv.Itoa(i)})
+	}
+	received(t, prober)
+
+	for _, msgType := range []string{msgJoin, msgSpectate, msgJoin} {
+		prober.handleRequest(InMessage{Type: msgType, GameCode: code, RequestID: "r1"})
+		msgs := received(t, prober)
+		if len(msgs) != 1 || msgs[0][jsonKeyCode] != errCodeRateLimited || msgs[0][jsonKeyRequest] != "r1" {
+			t.Fatalf("%s frenado debería responder solo RATE_LIMITED, llegó %v", msgType, msgs)
+		}
+	}
+}
+
+func TestAsyncErrorIsNotTakenAsRequestReply(t *testing.T) {
+	h := startTestHub(t)
+	c := newRecordingClient(h, "10.17.3.1")
+	c.requestID = "q1"
+	c.sendAsyncError(errNoGameCode)
+	if c.requestReply != nil {
+		t.Fatalf("un error asíncrono se ha guardado como respuesta de q1")
+	}
+	if msgs := received(t, c); len(msgs) != 1 || msgs[0][jsonKeyRequest] != nil {
+		t.Fatalf("el error asíncrono no debería llevar requestId, llegó %v", msgs)
+	}
+}
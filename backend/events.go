@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Emotes disponibles para react
+var validEmotes = map[string]bool{
+	"nice_roll": true,
+	"ouch":      true,
+	"gg":        true,
+	"wow":       true,
+	"hurry":     true,
+	"thanks":    true,
+}
+
+// gameEvent es un evento emitido a la mesa, con el momento en que se emitió,
+// para poder reproducir la partida.
+type gameEvent struct {
+	At    int64           `json:"at"` // Unix en milisegundos
+	Event json.RawMessage `json:"event"`
+}
+
+// recordEvent añade un evento ya serializado al registro de la partida,
+// acotado a Cfg.EventLogSize.
+func (g *Game) recordEvent(data []byte) {
+	g.events = append(g.events, gameEvent{At: time.Now().UnixMilli(), Event: data})
+	if over := len(g.events) - Cfg.EventLogSize; over > 0 {
+		g.events = append(g.events[:0], g.events[over:]...)
+	}
+}
+
+// handleReact difunde una reacción rápida del jugador.
+func (g *Game) handleReact(c *Client, msg InMessage) {
+	seat := g.seatOf(c)
+	if seat < 0 {
+		g.sendNotSeated(c)
+		return
+	}
+	if !validEmotes[msg.Emote] {
+		c.sendError(errInvalidEmote)
+		return
+	}
+	g.broadcast(map[string]any{
+		jsonKeyType:   msgReaction,
+		"playerIndex": seat,
+		"emote":       msg.Emote,
+	})
+}
+
+// handleGetEvents envía al cliente el registro de eventos de la partida.
+func (g *Game) handleGetEvents(c *Client) {
+	if g.seatOf(c) < 0 && !g.spectators[c] {
+		c.sendError(errNoGame)
+		return
+	}
+	events := g.events
+	if events == nil {
+		events = []gameEvent{}
+	}
+	c.sendJSON(map[string]any{jsonKeyType: msgEventLog, "events": events})
+}
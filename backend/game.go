@@ -0,0 +1,480 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// gameCommandBuffer es la capacidad de la cola de comandos de cada partida.
+const gameCommandBuffer = 64
+
+// maxGameCodeAttempts limita los códigos que se prueban al crear una partida
+// antes de desistir (solo se agota con casi todos los códigos en uso).
+const maxGameCodeAttempts = 100
+
+// Game es una partida. Cada partida tiene su propio event loop (run) que
+// ejecuta en orden los comandos que le envían las conexiones y el Hub; todos
+// los campos de la partida pertenecen a esa goroutine y solo se tocan desde
+// comandos. Los eventos (broadcast, broadcastState) se emiten desde el propio
+// loop, así que todos los jugadores los reciben en el mismo orden en que se
+// producen. Enviar a un cliente nunca bloquea (ver Client.enqueue).
+type Game struct {
+	hub                     *Hub
+	code                    string
+	clients                 []*Client
+	playerNames             []string
+	totals                  []int
+	currentPlayerIndex      int
+	dice                    []Die
+	selectedIndices         []int
+	turnPoints              int
+	turnMoves               []TurnMove
+	hasApartadoThisRoll     bool
+	victoryScore            int
+	bonusAfterSecondHotDice bool
+	hotDiceCountThisTurn    int
+	lastHotDiceBonus        int
+	finalRoundTriggerIndex  int // -1 si no ha pasado
+	finalRoundPlayedExtra   []bool
+	winnerIndex             int              // -1 si la partida sigue
+	finishedAt              time.Time        // cuándo terminó la partida
+	gameHistory             []map[string]any // historial de partidas terminadas en esta sala
+	gameStarted             bool             // true tras handleStartGame; distingue lobby de partida en curso
+	ready                   []bool           // jugadores que han marcado "listo" en el lobby
+	minPlayers              int              // jugadores necesarios para empezar
+	host                    int              // asiento del anfitrión: al principio el creador
+	turnOrder               []int            // asientos en orden de turno
+	resumeTokens            []string         // token para recuperar cada asiento tras una desconexión ("" = ninguno)
+	seatRequests            []requestCache   // respuestas a requestId de la conexión que dejó cada asiento
+	public                  bool             // aparece en el listado de lobbies mientras esté abierta
+	passwordHash            []byte           // hash de la contraseña de la sala (nil = sin contraseña)
+	bannedClients           map[*Client]bool // conexiones vetadas por el anfitrión
+	bannedIPs               map[string]bool  // IPs vetadas por el anfitrión
+	spectators              map[*Client]bool // espectadores: reciben estado y eventos, pero no juegan
+	allowSpectators         bool
+	chatHistory             []chatLine               // últimas Cfg.ChatHistorySize líneas de chat
+	mutes                   map[*Client]map[int]bool // asientos silenciados por cada jugador
+	events                  []gameEvent              // eventos emitidos con broadcast, para repeticiones
+	turnLimit               time.Duration            // tiempo máximo de cada turno (0 = sin límite)
+	turnExpiry              string                   // qué pasa al vencer el turno (turnExpiryAuto o turnExpiryForfeit)
+	clockLimit              time.Duration            // tiempo total de cada jugador en modo reloj de ajedrez (0 = sin reloj)
+	clocks                  []time.Duration          // tiempo de reloj que le queda a cada jugador
+	outOfTime               []bool                   // jugadores que han agotado su reloj y han perdido
+	turnTimer               *time.Timer              // vence el turno en curso (nil = sin límite)
+	turnTimerSeat           int                      // jugador cuyo turno cuenta turnTimer
+	turnTimerSeq            int                      // cambia al parar turnTimer, para descartar vencimientos ya encolados
+	turnStartedAt           time.Time                // cuándo empezó a contar turnTimer
+	turnDeadline            time.Time                // cuándo vence el turno en curso (cero = sin límite)
+	timeouts                []int                    // turnos vencidos seguidos de cada jugador
+	afkSince                []time.Time              // desde cuándo está ausente cada jugador (cero = presente)
+	undoStack               []setAsideUndo           // set_aside de la tirada actual que se pueden deshacer
+	createdAt               time.Time                // cuándo se creó, para ordenar el listado de lobbies
+	stateVersion            int                      // versión del último game_state emitido
+	stateHistory            []stateSnapshot          // últimas versiones emitidas, para calcular parches
+	stateAcks               map[*Client]int          // última versión confirmada con state_ack por cada jugador
+	commands                chan func()              // comandos pendientes del event loop
+	done                    chan struct{}            // se cierra cuando la partida termina su event loop
+	closed                  bool                     // true tras close; el loop sale después del comando actual
+}
+
+func newGame(hub *Hub, code string, numPlayers int) *Game {
+	return &Game{
+		hub:                    hub,
+		code:                   code,
+		clients:                make([]*Client, numPlayers),
+		playerNames:            make([]string, numPlayers),
+		resumeTokens:           make([]string, numPlayers),
+		seatRequests:           make([]requestCache, numPlayers),
+		ready:                  make([]bool, numPlayers),
+		turnOrder:              identityTurnOrder(numPlayers),
+		minPlayers:             min(Cfg.MinPlayers, numPlayers),
+		totals:                 make([]int, numPlayers),
+		finalRoundTriggerIndex: invalidIndex,
+		finalRoundPlayedExtra:  make([]bool, numPlayers),
+		winnerIndex:            invalidIndex,
+		createdAt:              time.Now(),
+		stateAcks:              make(map[*Client]int),
+		spectators:             make(map[*Client]bool),
+		mutes:                  make(map[*Client]map[int]bool),
+		allowSpectators:        true,
+		turnLimit:              Cfg.TurnTimeLimit,
+		turnExpiry:             turnExpiryAuto,
+		clockLimit:             Cfg.ChessClock,
+		clocks:                 make([]time.Duration, numPlayers),
+		outOfTime:              make([]bool, numPlayers),
+		timeouts:               make([]int, numPlayers),
+		afkSince:               make([]time.Time, numPlayers),
+		commands:               make(chan func(), gameCommandBuffer),
+		done:                   make(chan struct{}),
+	}
+}
+
+// run es el event loop de la partida. Termina cuando un comando llama a close.
+func (g *Game) run() {
+	for !g.closed {
+		cmd := <-g.commands
+		cmd()
+	}
+}
+
+// do encola cmd en el event loop sin esperar a que se ejecute. Devuelve false
+// si la partida ya está cerrada. No debe llamarse desde el propio event loop.
+func (g *Game) do(cmd func()) bool {
+	select {
+	case <-g.done:
+		return false
+	default:
+	}
+	select {
+	case g.commands <- cmd:
+		return true
+	case <-g.done:
+		return false
+	}
+}
+
+// call ejecuta cmd en el event loop y espera a que termine. Devuelve false si
+// la partida se cerró antes de ejecutarlo.
+func (g *Game) call(cmd func()) bool {
+	started := make(chan struct{})
+	finished := make(chan struct{})
+	queued := g.do(func() {
+		close(started)
+		defer close(finished)
+		cmd()
+	})
+	if !queued {
+		return false
+	}
+
+	select {
+	case <-finished:
+		return true
+	case <-g.done:
+	}
+	// done solo se cierra desde un comando y el loop no empieza ninguno más
+	// después: si cmd no había empezado, ya no se ejecutará.
+	select {
+	case <-started:
+		<-finished
+		return true
+	default:
+		return false
+	}
+}
+
+// close quita la partida del Hub y detiene su event loop. Los comandos
+// pendientes se descartan. Solo puede llamarse desde el event loop.
+func (g *Game) close() {
+	if g.closed {
+		return
+	}
+	g.closed = true
+	g.stopTurnTimer()
+	close(g.done)
+	g.hub.removeGame(g)
+	g.publishLobby()
+}
+
+// closeIfExpired cierra la partida si terminó hace más de Cfg.FinishedGameRetention.
+func (g *Game) closeIfExpired() {
+	if g.winnerIndex >= 0 && !g.finishedAt.IsZero() && time.Since(g.finishedAt) > Cfg.FinishedGameRetention {
+		g.close()
+		log.Printf("Partida %s eliminada (terminada hace >%v)", g.code, Cfg.FinishedGameRetention)
+	}
+}
+
+// generateGameCode genera un código de partida aleatorio con crypto/rand, para
+// que no se pueda predecir el siguiente a partir de los anteriores.
+func generateGameCode() (string, error) {
+	b := make([]byte, Cfg.GameCodeLength)
+	n := big.NewInt(int64(len(Cfg.GameCodeChars)))
+	for i := range b {
+		idx, err := rand.Int(rand.Reader, n)
+		if err != nil {
+			return "", err
+		}
+		b[i] = Cfg.GameCodeChars[idx.Int64()]
+	}
+	return string(b), nil
+}
+
+// newResumeToken genera un token aleatorio para recuperar un asiento.
+func newResumeToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// setMinPlayers fija los jugadores necesarios para empezar, entre 2 y el
+// número de asientos.
+func (g *Game) setMinPlayers(n int) {
+	g.minPlayers = min(max(n, 2), len(g.clients))
+}
+
+// validMaxPlayers indica si n es un número de asientos válido para una partida.
+func validMaxPlayers(n int) bool {
+	return n >= 2 && n <= Cfg.NumPlayers
+}
+
+// canResize indica si la partida puede pasar a tener n asientos: entre 2 y
+// Cfg.NumPlayers y sin dejar fuera ningún asiento ocupado.
+func (g *Game) canResize(n int) bool {
+	if !validMaxPlayers(n) {
+		return false
+	}
+	for i := n; i < len(g.clients); i++ {
+		if g.clients[i] != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// resize cambia el número de asientos de la partida (en el lobby). Debe
+// comprobarse antes con canResize.
+func (g *Game) resize(n int) {
+	g.clients = resizeSlice(g.clients, n)
+	g.playerNames = resizeSlice(g.playerNames, n)
+	g.totals = resizeSlice(g.totals, n)
+	g.resumeTokens = resizeSlice(g.resumeTokens, n)
+	g.seatRequests = resizeSlice(g.seatRequests, n)
+	g.ready = resizeSlice(g.ready, n)
+	g.clocks = resizeSlice(g.clocks, n)
+	g.outOfTime = resizeSlice(g.outOfTime, n)
+	g.timeouts = resizeSlice(g.timeouts, n)
+	g.afkSince = resizeSlice(g.afkSince, n)
+	g.finalRoundPlayedExtra = make([]bool, n)
+
+	order := make([]int, 0, n)
+	for _, seat := range g.turnOrder {
+		if seat < n {
+			order = append(order, seat)
+		}
+	}
+	for seat := len(g.turnOrder); seat < n; seat++ {
+		order = append(order, seat)
+	}
+	g.turnOrder = order
+	g.minPlayers = min(g.minPlayers, n)
+}
+
+// resizeSlice devuelve s con longitud n, recortada o ampliada con ceros.
+func resizeSlice[T any](s []T, n int) []T {
+	if n <= len(s) {
+		return s[:n:n]
+	}
+	return append(s, make([]T, n-len(s))...)
+}
+
+// seatOf devuelve el asiento del cliente en la partida, o -1 si no está sentado.
+func (g *Game) seatOf(c *Client) int {
+	for i, other := range g.clients {
+		if other == c {
+			return i
+		}
+	}
+	return invalidIndex
+}
+
+// broadcast envía payload a todos los jugadores y espectadores de la partida y
+// lo guarda en el registro de eventos.
+func (g *Game) broadcast(payload any) {
+	data, _ := json.Marshal(payload)
+	g.recordEvent(data)
+	for _, client := range g.clients {
+		if client != nil {
+			client.sendRaw(data)
+		}
+	}
+	for client := range g.spectators {
+		client.sendRaw(data)
+	}
+}
+
+// broadcastState envía el estado de la partida a todos los jugadores y
+// espectadores: un parche a los que han confirmado una versión reciente y el
+// estado completo al resto. Como todo cambio de la partida acaba aquí, también
+// actualiza su entrada en el listado de lobbies.
+func (g *Game) broadcastState() {
+	g.publishLobby()
+	version, doc, err := g.snapshotState()
+	if err != nil {
+		log.Println("No se pudo serializar el estado de la partida:", err)
+		return
+	}
+
+	// Los mensajes se cachean por versión base: todos los clientes que han
+	// confirmado la misma versión reciben exactamente el mismo parche.
+	byBase := make(map[int][]byte)
+	send := func(client *Client) {
+		base := g.stateAcks[client]
+		data, ok := byBase[base]
+		if !ok {
+			data = g.stateMessage(base, version, doc)
+			byBase[base] = data
+		}
+		client.sendState(data)
+	}
+	for _, client := range g.clients {
+		if client != nil {
+			send(client)
+		}
+	}
+	for client := range g.spectators {
+		send(client)
+	}
+}
+
+// stateDocument construye el estado visible de la partida (sin el campo type).
+func (g *Game) stateDocument() map[string]any {
+	players := make([]map[string]any, len(g.clients))
+	for i := range players {
+		active := i < len(g.clients) && g.clients[i] != nil
+		name := ""
+		total := 0
+		if active {
+			if i < len(g.playerNames) && g.playerNames[i] != "" {
+				name = g.playerNames[i]
+			} else {
+				name = "Jugador " + strconv.Itoa(i+1)
+			}
+			if i < len(g.totals) {
+				total = g.totals[i]
+			}
+		}
+		players[i] = map[string]any{
+			"name":   name,
+			"total":  total,
+			"active": active,
+			"ready":  active && i < len(g.ready) && g.ready[i],
+			"afk":    active && g.isAFK(i),
+		}
+		if g.clockLimit > 0 {
+			players[i]["clockMs"] = g.clocks[i].Milliseconds()
+			players[i]["outOfTime"] = g.outOfTime[i]
+		}
+	}
+
+	remainingCount := 0
+	for _, d := range g.dice {
+		if !d.Held {
+			remainingCount++
+		}
+	}
+
+	status := "playing"
+	if g.winnerIndex >= 0 {
+		status = "finished"
+	}
+	turnMoves := g.turnMoves
+	if turnMoves == nil {
+		turnMoves = []TurnMove{}
+	}
+	turnDeadline := int64(0)
+	if !g.turnDeadline.IsZero() {
+		turnDeadline = g.turnDeadline.UnixMilli()
+	}
+	gameHistory := g.gameHistory
+	if gameHistory == nil {
+		gameHistory = []map[string]any{}
+	}
+	return map[string]any{
+		"players":                 players,
+		"gameStarted":             g.gameStarted,
+		"minPlayers":              g.minPlayers,
+		"hostIndex":               g.host,
+		"spectators":              len(g.spectators),
+		"allowSpectators":         g.allowSpectators,
+		"bonusAfterSecondHotDice": g.bonusAfterSecondHotDice,
+		"currentPlayerIndex":      g.currentPlayerIndex,
+		"turnOrder":               g.turnOrder,
+		"turnSeconds":             int(g.turnLimit / time.Second),
+		"clockSeconds":            int(g.clockLimit / time.Second),
+		"turnExpiry":              g.turnExpiry,
+		"turnDeadline":            turnDeadline,
+		"dice":                    g.dice,
+		"selectedIndices":         g.selectedIndices,
+		"remainingDiceCount":      remainingCount,
+		"turnPoints":              g.turnPoints,
+		"turnMoves":               turnMoves,
+		"canUndo":                 len(g.undoStack) > 0,
+		"victoryScore":            g.victoryScore,
+		"finalRoundTriggerIndex":  g.finalRoundTriggerIndex,
+		"winnerIndex":             g.winnerIndex,
+		"status":                  status,
+		"gameHistory":             gameHistory,
+	}
+}
+
+// appendFinishedGameToHistory guarda la partida recién terminada en el historial.
+// Solo incluye jugadores que participaron (playerNames[i] != "").
+// Debe llamarse justo después de asignar g.winnerIndex.
+func (g *Game) appendFinishedGameToHistory() {
+	players := make([]map[string]any, 0)
+	for i := range g.playerNames {
+		if i >= len(g.playerNames) || g.playerNames[i] == "" {
+			continue
+		}
+		name := g.playerNames[i]
+		total := 0
+		if i < len(g.totals) {
+			total = g.totals[i]
+		}
+		players = append(players, map[string]any{"name": name, "total": total, "index": i})
+	}
+	turnOrder := make([]int, 0, len(players))
+	for _, seat := range g.turnOrder {
+		if g.playerNames[seat] != "" {
+			turnOrder = append(turnOrder, seat)
+		}
+	}
+	g.gameHistory = append(g.gameHistory, map[string]any{
+		"players":     players,
+		"winnerIndex": g.winnerIndex,
+		"turnOrder":   turnOrder,
+	})
+}
+
+// contending indica si el asiento i sigue en juego: tiene jugador y no ha
+// agotado su reloj.
+func (g *Game) contending(i int) bool {
+	return g.clients[i] != nil && !g.outOfTime[i]
+}
+
+// nextActivePlayerIndex devuelve el siguiente índice de jugador que sigue en
+// juego (ver contending) después de from en el orden de turnos, recorriendo de
+// forma circular (con from = -1, el primero). Se salta a los jugadores ausentes
+// salvo que lo estén todos. Devuelve -1 si no hay ninguno.
+func (g *Game) nextActivePlayerIndex(from int) int {
+	n := len(g.turnOrder)
+	if n == 0 {
+		return -1
+	}
+	pos := -1
+	for i, seat := range g.turnOrder {
+		if seat == from {
+			pos = i
+			break
+		}
+	}
+	fallback := -1
+	for step := 1; step <= n; step++ {
+		idx := g.turnOrder[(pos+step+n)%n]
+		if !g.contending(idx) {
+			continue
+		}
+		if !g.isAFK(idx) {
+			return idx
+		}
+		if fallback < 0 {
+			fallback = idx
+		}
+	}
+	return fallback
+}
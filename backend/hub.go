@@ -1,11 +1,13 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"log"
 	"math/rand"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -17,6 +19,23 @@ const (
 	msgPong               = "pong"
 	msgCreate             = "create"
 	msgJoin               = "join"
+	msgLeave              = "leave"
+	msgQueue              = "queue"
+	msgLeaveQueue         = "leave_queue"
+	msgKick               = "kick"
+	msgReady              = "ready"
+	msgReorderSeats       = "reorder_seats"
+	msgSpectate           = "spectate"
+	msgChat               = "chat"
+	msgMute               = "mute"
+	msgUnmute             = "unmute"
+	msgReact              = "react"
+	msgGetEvents          = "get_events"
+	msgBack               = "back"
+	msgUndoSetAside       = "undo_set_aside"
+	msgSetAsideAndRoll    = "set_aside_and_roll"
+	msgSetAsideAndBank    = "set_aside_and_bank"
+	msgBan                = "ban"
 	msgStart              = "start"
 	msgUpdateConfig       = "update_config"
 	msgRestart            = "restart"
@@ -24,19 +43,49 @@ const (
 	msgToggleSelect       = "toggle_select"
 	msgSetAside           = "set_aside"
 	msgBank               = "bank"
+	msgStateAck           = "state_ack"
+	msgGetState           = "get_state"
+	msgResync             = "resync"
+	msgListGames          = "list_games"
+	msgSubscribeLobbies   = "subscribe_lobbies"
+	msgUnsubscribeLobbies = "unsubscribe_lobbies"
 	msgError              = "error"
+	msgAck                = "ack"
+	msgResynced           = "resynced"
+	msgGamesList          = "games_list"
+	msgLobbyUpdated       = "lobby_updated"
+	msgLobbyRemoved       = "lobby_removed"
+	msgQueueStatus        = "queue_status"
+	msgQueueLeft          = "queue_left"
+	msgQueueTimeout       = "queue_timeout"
 	msgGameCreated        = "game_created"
 	msgGameJoined         = "game_joined"
 	msgGameStarted        = "game_started"
 	msgGameState          = "game_state"
+	msgGameStatePatch     = "game_state_patch"
 	msgGameOver           = "game_over"
 	msgPlayerJoined       = "player_joined"
 	msgPlayerDisconnected = "player_disconnected"
+	msgPlayerLeft         = "player_left"
+	msgPlayerKicked       = "player_kicked"
+	msgKicked             = "kicked"
+	msgRollOff            = "roll_off"
+	msgSpectating         = "spectating"
+	msgChatHistory        = "chat_history"
+	msgReaction           = "reaction"
+	msgEventLog           = "event_log"
+	msgLeftGame           = "left_game"
 	msgRollResult         = "roll_result"
 	msgFarkle             = "farkle"
 	msgHotDice            = "hot_dice"
 	msgTurnChanged        = "turn_changed"
 	msgFinalRound         = "final_round"
+	msgTurnTimeout        = "turn_timeout"
+	msgOutOfTime          = "out_of_time"
+	msgPlayerAFK          = "player_afk"
+	msgPlayerReturned     = "player_returned"
+	msgPlayerRemovedAFK   = "player_removed_afk"
+	msgRemovedAFK         = "removed_afk"
 )
 
 const (
@@ -44,6 +93,10 @@ const (
 	jsonKeyMsg      = "message"
 	jsonKeyGameCode = "gameCode"
 	jsonKeyWinner   = "winner"
+	jsonKeySeq      = "seq"
+	jsonKeyRequest  = "requestId"
+	jsonKeyCode     = "code"
+	jsonKeyResume   = "resumeToken"
 )
 
 // Mensajes de error
@@ -54,6 +107,27 @@ const (
 	errGameFinished       = "The game has ended"
 	errGameFull           = "Game is full"
 	errGameCodeRequired   = "Game code required"
+	errGameAlreadyStarted = "Game has already started"
+	errGameNotStarted     = "Game has not started yet"
+	errAlreadyInGame      = "You are already in this game"
+	errInvalidResumeToken = "Invalid resume token"
+	errInvalidQueue       = "Invalid queue options"
+	errNotQueued          = "You are not in the matchmaking queue"
+	errWrongPassword      = "Wrong room password"
+	errPasswordLocked     = "Too many wrong passwords, try again later"
+	errNoGameCode         = "Could not create the game, try again"
+	errBanned             = "You have been banned from this game"
+	errNotEnoughPlayers   = "Not enough players to start"
+	errPlayersNotReady    = "Not all players are ready"
+	errInvalidTurnOrder   = "Invalid turn order"
+	errInvalidMaxPlayers  = "Invalid max players"
+	errSpectator          = "Spectators cannot play"
+	errNoSpectators       = "This game does not allow spectators"
+	errInvalidChat        = "Invalid chat message"
+	errChatRejected       = "Chat message rejected"
+	errInvalidEmote       = "Unknown emote"
+	errInvalidTurnTimer   = "Invalid turn timer"
+	errNothingToUndo      = "Nothing to undo since the last roll"
 	errInvalidJSON        = "Invalid JSON"
 	errInvalidIndex       = "Invalid index"
 	errRollWithoutApartar = "You must set aside at least one scoring die before rolling again"
@@ -64,6 +138,14 @@ const (
 	errInvalidSelection   = "Invalid selection: all dice must score"
 	errBankNoPoints       = "You have no points to bank"
 	errBankMustApartar    = "You must set aside at least one combination before banking"
+	errInvalidVersion     = "Invalid state version"
+	errInvalidRequestID   = "Invalid request ID"
+	errRateLimited        = "Too many requests, slow down"
+)
+
+// Códigos de error tipados (campo code de los mensajes de error)
+const (
+	errCodeRateLimited = "RATE_LIMITED"
 )
 
 const (
@@ -78,22 +160,68 @@ type InMessage struct {
 	Index        int    `json:"index"`
 	VictoryScore int    `json:"victoryScore"`
 	BonusAfterSecondHotDice bool `json:"bonusAfterSecondHotDice"`
+	Version      int    `json:"version"`
+	RequestID    string `json:"requestId"`
+	ResumeToken  string `json:"resumeToken"`
+	Public       bool   `json:"public"`
+	TableSize    int    `json:"tableSize"`
+	MinVictoryScore int `json:"minVictoryScore"`
+	MaxVictoryScore int `json:"maxVictoryScore"`
+	Password     *string `json:"password"` // nil = sin cambios en update_config; "" = sin contraseña
+	MinPlayers   int    `json:"minPlayers"`
+	TurnOrder    string `json:"turnOrder"`
+	MaxPlayers   int    `json:"maxPlayers"`
+	AllowSpectators *bool `json:"allowSpectators"` // nil = sin cambios (por defecto se permiten)
+	Text         string `json:"text"`
+	Emote        string `json:"emote"`
+	TurnSeconds  *int   `json:"turnSeconds"`  // nil = sin cambios; 0 = sin límite por turno
+	ClockSeconds *int   `json:"clockSeconds"` // nil = sin cambios; 0 = sin reloj de ajedrez
+	TurnExpiry   string `json:"turnExpiry"`   // "" = sin cambios
 }
 
 type Hub struct {
-	clients    map[*Client]bool
-	games      map[string]*Game
-	register   chan *Client
-	unregister chan *Client
-	mu         sync.RWMutex
+	clients         map[*Client]bool
+	games           map[string]*Game
+	register        chan *Client
+	unregister      chan *Client
+	conns           ipConnLimiter    // conexiones abiertas por IP
+	createLimiter   keyedRateLimiter // partidas creadas por IP
+	listLimiter     keyedRateLimiter // consultas a GET /games por IP
+	lobbies         lobbyBoard       // partidas públicas abiertas y suscriptores del listado
+	matchmaker      *matchmaker      // cola de partida rápida
+	passwordLockout passwordLockout  // contraseñas de sala erróneas por IP
+	chatFilter      ChatFilter       // filtro de los mensajes de chat
+	mu              sync.RWMutex
 }
 
 type Client struct {
 	hub         *Hub
 	conn        *websocket.Conn
+	ip          string
 	send        chan []byte
-	gameCode    string
-	playerIndex int
+	// game es la última partida en la que se ha sentado el cliente. La
+	// modifican readPump y el matchmaker (mientras el cliente está en cola); el
+	// asiento real lo decide la partida (Game.seatOf), que puede haberlo liberado.
+	game atomic.Pointer[Game]
+
+	// mu protege el estado de envío: seq, el game_state pendiente de
+	// coalescer, el inicio de la saturación y si send ya está cerrado.
+	mu             sync.Mutex
+	seq            uint64        // número de secuencia del último mensaje saliente
+	pendingState   []byte        // último game_state que no cupo en send
+	stateReady     chan struct{} // avisa a writePump de que hay un pendingState
+	saturatedSince time.Time     // desde cuándo send está lleno (cero = no lo está)
+	closed         bool
+
+	// requestID, requestReply y rateLimited solo los usa la goroutine de
+	// readPump mientras procesa un mensaje con requestId; requests guarda las
+	// respuestas recientes.
+	requestID    string
+	requestReply []byte
+	rateLimited  bool // la respuesta ha sido RATE_LIMITED: ni ack ni caché
+	requests     requestCache
+	limits       map[string]*tokenBucket // límites de mensajes por tipo, solo desde readPump
+	joinMisses   *tokenBucket            // joins a códigos inexistentes, solo desde readPump
 }
 
 type Die struct {
@@ -108,86 +236,20 @@ type TurnMove struct {
 	IsBonus bool `json:"isBonus"`
 }
 
-// appendFinishedGameToHistory guarda la partida recién terminada en el historial.
-// Solo incluye jugadores que participaron (playerNames[i] != "").
-// Debe llamarse con g.mu bloqueado, justo después de asignar g.winnerIndex.
-func (g *Game) appendFinishedGameToHistory() {
-	players := make([]map[string]any, 0)
-	for i := range g.playerNames {
-		if i >= len(g.playerNames) || g.playerNames[i] == "" {
-			continue
-		}
-		name := g.playerNames[i]
-		total := 0
-		if i < len(g.totals) {
-			total = g.totals[i]
-		}
-		players = append(players, map[string]any{"name": name, "total": total, "index": i})
-	}
-	g.gameHistory = append(g.gameHistory, map[string]any{
-		"players":     players,
-		"winnerIndex": g.winnerIndex,
-	})
-}
-
-type Game struct {
-	code                   string
-	clients                []*Client
-	playerNames            []string
-	totals                 []int
-	currentPlayerIndex     int
-	dice                   []Die
-	selectedIndices        []int
-	turnPoints             int
-	turnMoves              []TurnMove
-	hasApartadoThisRoll    bool
-	victoryScore           int
-	bonusAfterSecondHotDice bool
-	hotDiceCountThisTurn    int
-	lastHotDiceBonus        int
-	finalRoundTriggerIndex int // -1 si no ha pasado
-	finalRoundPlayedExtra  []bool
-	winnerIndex            int              // -1 si la partida sigue
-	finishedAt             time.Time        // cuándo terminó la partida
-	gameHistory            []map[string]any // historial de partidas terminadas en esta sala
-	gameStarted            bool             // true tras handleStartGame; distingue lobby de partida en curso
-	mu                     sync.RWMutex
-}
-
-// nextActivePlayerIndex devuelve el siguiente índice de jugador con cliente activo
-// empezando después de from, recorriendo de forma circular. Devuelve -1 si no hay ninguno.
-func (g *Game) nextActivePlayerIndex(from int) int {
-	n := len(g.clients)
-	if n == 0 {
-		return -1
-	}
-	for step := 1; step <= n; step++ {
-		idx := (from + step) % n
-		if g.clients[idx] != nil {
-			return idx
-		}
-	}
-	return -1
-}
-
 func newHub() *Hub {
-	return &Hub{
+	h := &Hub{
 		clients:    make(map[*Client]bool),
 		games:      make(map[string]*Game),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 	}
-}
-
-func generateGameCode() string {
-	b := make([]byte, Cfg.GameCodeLength)
-	for i := range b {
-		b[i] = Cfg.GameCodeChars[rand.Intn(len(Cfg.GameCodeChars))]
-	}
-	return string(b)
+	h.matchmaker = newMatchmaker(h)
+	h.chatFilter = newWordListFilter(Cfg.ChatBannedWords)
+	return h
 }
 
 func (h *Hub) run() {
+	go h.matchmaker.run()
 	for {
 		select {
 		case client := <-h.register:
@@ -195,148 +257,257 @@ func (h *Hub) run() {
 			wsConnections.Inc()
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
-				h.handleClientDisconnect(client)
+				// Primero la cola: si el matchmaker acaba de sentar al
+				// cliente en una partida, al volver client.game ya la apunta.
+				h.matchmaker.dequeue(client, queueDisconnected)
+				if g := client.game.Load(); g != nil {
+					g.do(func() { g.handleClientDisconnect(client) })
+				}
+				h.lobbies.unsubscribe(client)
 				delete(h.clients, client)
-				close(client.send)
+				client.closeSend()
 				wsConnections.Dec()
 			}
 		}
 	}
 }
 
-func (h *Hub) handleClientDisconnect(client *Client) {
-	if client.gameCode == "" {
-		return
-	}
-
-	h.mu.RLock()
-	g, ok := h.games[client.gameCode]
-	h.mu.RUnlock()
-	if !ok {
+// handleClientDisconnect libera el asiento de un cliente que se ha desconectado.
+func (g *Game) handleClientDisconnect(client *Client) {
+	seat := g.seatOf(client)
+	if seat < 0 {
+		g.removeSpectator(client)
 		return
 	}
+	// readPump ya ha terminado: la caché de requestId se puede traspasar
+	g.seatRequests[seat] = client.requests
+	g.removePlayer(seat, msgPlayerDisconnected)
+}
 
-	g.mu.Lock()
-	if client.playerIndex < 0 || client.playerIndex >= len(g.clients) || g.clients[client.playerIndex] != client {
-		g.mu.Unlock()
-		return
-	}
+// departureVerbs describe en los avisos cómo se ha ido un jugador, según el
+// tipo de evento.
+var departureVerbs = map[string]string{
+	msgPlayerDisconnected: "se ha desconectado",
+	msgPlayerLeft:         "ha abandonado la partida",
+	msgPlayerKicked:       "ha sido expulsado de la partida",
+	msgPlayerRemovedAFK:   "ha dejado la partida por inactividad",
+}
 
-	g.clients[client.playerIndex] = nil
+// removePlayer libera un asiento y aplica las consecuencias en la partida. En
+// el lobby solo libera el asiento (y cierra la sala si queda vacía). Con la
+// partida empezada, si se va el anfitrión o solo queda un jugador en juego, la
+// partida termina; si el que se va tenía el turno, el turno pasa al siguiente.
+// event indica cómo se ha ido (msgPlayerDisconnected, msgPlayerLeft,
+// msgPlayerKicked o msgPlayerRemovedAFK) y es el tipo del aviso al resto.
+func (g *Game) removePlayer(seat int, event string) {
+	// Las salidas voluntarias o forzadas se anuncian siempre; las desconexiones
+	// solo cuando terminan la partida.
+	announce := event != msgPlayerDisconnected
+	verb := departureVerbs[event]
+	delete(g.stateAcks, g.clients[seat])
+	delete(g.mutes, g.clients[seat])
+	// Los silencios son por asiento: quien se siente después empieza sin ellos
+	for _, muted := range g.mutes {
+		delete(muted, seat)
+	}
+	g.clients[seat] = nil
+	g.ready[seat] = false
+	g.timeouts[seat] = 0
+	g.afkSince[seat] = time.Time{}
 
 	if g.winnerIndex >= 0 {
-		g.mu.Unlock()
+		if announce {
+			g.broadcast(map[string]any{
+				jsonKeyType:   event,
+				"playerIndex": seat,
+			})
+			g.broadcastState()
+		}
 		return
 	}
 
-	// Calcular jugadores restantes todavía en la partida
+	// Calcular jugadores sentados y, de ellos, los que siguen en juego (los que
+	// han agotado su reloj siguen sentados, pero ya no pueden ganar)
+	seated := make([]int, 0, len(g.clients))
 	remaining := make([]int, 0, len(g.clients))
 	for i, other := range g.clients {
 		if other != nil {
+			seated = append(seated, i)
+		}
+		if g.contending(i) {
 			remaining = append(remaining, i)
 		}
 	}
 
 	// Si no queda nadie, eliminamos la partida
-	if len(remaining) == 0 {
-		g.mu.Unlock()
-		h.mu.Lock()
-		delete(h.games, client.gameCode)
-		activeGames.Dec()
-		h.mu.Unlock()
+	if len(seated) == 0 {
+		g.close()
 		return
 	}
 
-	gameCode := client.gameCode
+	// En el lobby no hay nada que perder: solo se libera el asiento. Si se va
+	// el anfitrión, pasa a serlo el primer jugador que queda.
+	if !g.gameStarted {
+		if seat == g.host {
+			g.host = seated[0]
+		}
+		if announce {
+			g.broadcast(map[string]any{
+				jsonKeyType:   event,
+				jsonKeyMsg:    g.playerNames[seat] + " " + verb,
+				"playerIndex": seat,
+			})
+		}
+		g.broadcastState()
+		return
+	}
 
-	// Si el creador abandona la partida y aún quedan jugadores, la partida termina para todos.
-	if client.playerIndex == 0 {
-		// Elegimos como ganador al primer jugador restante (por simplicidad)
+	// Si el anfitrión abandona la partida y aún quedan jugadores, la partida
+	// termina para todos. Si se le retira por inactividad, la partida sigue y
+	// pasa a ser anfitrión el primer jugador que queda.
+	if seat == g.host && event == msgPlayerRemovedAFK {
+		g.host = seated[0]
+	} else if seat == g.host {
+		// Elegimos como ganador al primer jugador que sigue en juego (por simplicidad)
 		winnerIndex := remaining[0]
 		g.winnerIndex = winnerIndex
 		g.finishedAt = time.Now()
 		g.appendFinishedGameToHistory()
-		g.mu.Unlock()
+		g.stopTurnTimer()
 
-		h.broadcastToGame(gameCode, map[string]any{
-			jsonKeyType:   msgPlayerDisconnected,
-			jsonKeyMsg:    "El creador se ha desconectado. La partida ha terminado.",
+		g.broadcast(map[string]any{
+			jsonKeyType:   event,
+			jsonKeyMsg:    "El creador " + verb + ". La partida ha terminado.",
 			jsonKeyWinner: winnerIndex,
+			"playerIndex": seat,
 		})
-		h.broadcastGameState(gameCode)
+		g.broadcastState()
 		return
 	}
 
-	// Si solo queda un jugador, ese jugador gana por desconexión del resto
+	// Si solo queda un jugador en juego, ese jugador gana por desconexión del resto
 	if len(remaining) == 1 {
 		winnerIndex := remaining[0]
 		g.winnerIndex = winnerIndex
 		g.finishedAt = time.Now()
 		g.appendFinishedGameToHistory()
-		g.mu.Unlock()
+		g.stopTurnTimer()
 
-		h.broadcastToGame(gameCode, map[string]any{
-			jsonKeyType:   msgPlayerDisconnected,
-			jsonKeyMsg:    "El otro jugador se ha desconectado. Ganas la partida.",
+		g.broadcast(map[string]any{
+			jsonKeyType:   event,
+			jsonKeyMsg:    "El otro jugador " + verb + ". Ganas la partida.",
 			jsonKeyWinner: winnerIndex,
+			"playerIndex": seat,
 		})
-		h.broadcastGameState(gameCode)
+		g.broadcastState()
 		return
 	}
 
 	// Si quedan varios jugadores, la partida continúa sin el jugador desconectado.
 	// Si el que se ha desconectado tenía el turno, terminamos su turno
 	// descartando sus puntos y pasamos el turno al siguiente jugador activo.
-	if client.playerIndex == g.currentPlayerIndex {
+	if seat == g.currentPlayerIndex {
 		// El jugador que se va pierde cualquier punto acumulado en el turno
-		g.turnPoints = 0
-		g.turnMoves = nil
-		g.dice = nil
-		g.selectedIndices = nil
-		g.hasApartadoThisRoll = false
-		g.hotDiceCountThisTurn = 0
-		g.lastHotDiceBonus = 0
+		g.resetTurn()
 
 		next := g.nextActivePlayerIndex(g.currentPlayerIndex)
 		if next >= 0 {
 			g.currentPlayerIndex = next
 		}
+		g.startTurnTimer()
 	}
 
-	g.mu.Unlock()
-	h.broadcastGameState(gameCode)
+	if announce {
+		g.broadcast(map[string]any{
+			jsonKeyType:   event,
+			jsonKeyMsg:    g.playerNames[seat] + " " + verb,
+			"playerIndex": seat,
+		})
+	}
+	g.broadcastState()
 }
 
 // cleanupFinishedGames elimina partidas terminadas hace más de FinishedGameRetention.
 func (h *Hub) cleanupFinishedGames() {
 	for range time.Tick(Cfg.CleanupInterval) {
-		h.mu.Lock()
-		now := time.Now()
-		for code, g := range h.games {
-			g.mu.RLock()
-			finished := g.winnerIndex >= 0 && !g.finishedAt.IsZero() && now.Sub(g.finishedAt) > Cfg.FinishedGameRetention
-			g.mu.RUnlock()
-			if finished {
-				delete(h.games, code)
-				activeGames.Dec()
-				log.Printf("Partida %s eliminada (terminada hace >%v)", code, Cfg.FinishedGameRetention)
-			}
+		h.createLimiter.prune(time.Now())
+		h.listLimiter.prune(time.Now())
+		h.passwordLockout.prune(time.Now())
+
+		h.mu.RLock()
+		games := make([]*Game, 0, len(h.games))
+		for _, g := range h.games {
+			games = append(games, g)
+		}
+		h.mu.RUnlock()
+
+		for _, g := range games {
+			g.do(g.closeIfExpired)
+		}
+	}
+}
+
+// addGame registra la partida con un código nuevo que no use ninguna otra
+// partida. Devuelve false si no lo encuentra en maxGameCodeAttempts intentos.
+func (h *Hub) addGame(g *Game) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := 0; i < maxGameCodeAttempts; i++ {
+		code, err := generateGameCode()
+		if err != nil {
+			return false
+		}
+		if _, taken := h.games[code]; !taken {
+			g.code = code
+			h.games[code] = g
+			return true
 		}
-		h.mu.Unlock()
+	}
+	return false
+}
+
+// game busca una partida registrada por su código.
+func (h *Hub) game(code string) (*Game, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	g, ok := h.games[code]
+	return g, ok
+}
+
+// removeGame quita la partida del registro si sigue registrada con su código.
+func (h *Hub) removeGame(g *Game) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.games[g.code] == g {
+		delete(h.games, g.code)
+		activeGames.Dec()
 	}
 }
 
+// readPump lee los mensajes del cliente. Si no llega nada (ni un pong) en
+// Cfg.PongWait, o llega un mensaje mayor que Cfg.MaxMessageSize, la lectura
+// falla y el cliente pasa por Hub.unregister.
 func (c *Client) readPump() {
 	defer func() {
 		c.hub.unregister <- c
 		c.conn.Close()
 	}()
 
+	c.conn.SetReadLimit(Cfg.MaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(Cfg.PongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(Cfg.PongWait))
+	})
+
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println("Conexión cerrada:", err)
+			}
 			break
 		}
+		c.conn.SetReadDeadline(time.Now().Add(Cfg.PongWait))
 
 		var msg InMessage
 		if err := json.Unmarshal(message, &msg); err != nil {
@@ -344,59 +515,223 @@ func (c *Client) readPump() {
 			continue
 		}
 
-		switch msg.Type {
-		case msgPing:
-			c.sendJSON(map[string]string{jsonKeyType: msgPong})
-		case msgCreate:
-			c.handleCreate(msg)
-		case msgJoin:
-			c.handleJoin(msg)
-		case msgStart:
-			c.handleStartGame(msg)
-		case msgUpdateConfig:
-			c.handleUpdateConfig(msg)
-		case msgRestart:
-			c.handleRestartGame(msg)
-		case msgRoll:
-			c.handleRoll()
-		case msgToggleSelect:
-			c.handleToggleSelect(msg)
-		case msgSetAside:
-			c.handleApartar()
-		case msgBank:
-			c.handleBank()
-		default:
-			c.sendError("tipo desconocido: " + msg.Type)
+		if ok, retryAfter := c.allowMessage(msg.Type); !ok {
+			c.sendRateLimited(msg, retryAfter)
+			continue
+		}
+
+		if msg.RequestID != "" {
+			c.handleRequest(msg)
+			continue
 		}
+		c.handleMessage(msg)
 	}
 }
 
+// handleMessage despacha un mensaje entrante a su handler.
+func (c *Client) handleMessage(msg InMessage) {
+	switch msg.Type {
+	case msgPing:
+		c.sendJSON(map[string]string{jsonKeyType: msgPong})
+	case msgCreate:
+		c.handleCreate(msg)
+	case msgJoin:
+		c.handleJoin(msg)
+	case msgLeave:
+		c.handleLeave()
+	case msgSpectate:
+		c.handleSpectate(msg)
+	case msgQueue:
+		c.handleQueue(msg)
+	case msgLeaveQueue:
+		c.handleLeaveQueue()
+	case msgStart:
+		c.inGame(func(g *Game) { g.handleStartGame(c, msg) })
+	case msgUpdateConfig:
+		c.inGame(func(g *Game) { g.handleUpdateConfig(c, msg) })
+	case msgRestart:
+		c.inGame(func(g *Game) { g.handleRestartGame(c, msg) })
+	case msgRoll:
+		c.inGame(func(g *Game) { g.handleRoll(c) })
+	case msgToggleSelect:
+		c.inGame(func(g *Game) { g.handleToggleSelect(c, msg) })
+	case msgSetAside:
+		c.inGame(func(g *Game) { g.handleApartar(c, msg) })
+	case msgSetAsideAndRoll:
+		c.inGame(func(g *Game) {
+			if g.setAside(c, msg.Values) {
+				g.handleRoll(c)
+			}
+		})
+	case msgSetAsideAndBank:
+		c.inGame(func(g *Game) {
+			if g.setAside(c, msg.Values) {
+				g.handleBank(c)
+			}
+		})
+	case msgUndoSetAside:
+		c.inGame(func(g *Game) { g.handleUndoSetAside(c) })
+	case msgBank:
+		c.inGame(func(g *Game) { g.handleBank(c) })
+	case msgReady:
+		c.inGame(func(g *Game) { g.handleReady(c) })
+	case msgReorderSeats:
+		c.inGame(func(g *Game) { g.handleReorderSeats(c, msg) })
+	case msgChat:
+		c.inGame(func(g *Game) { g.handleChat(c, msg) })
+	case msgMute:
+		c.inGame(func(g *Game) { g.handleMute(c, msg, true) })
+	case msgUnmute:
+		c.inGame(func(g *Game) { g.handleMute(c, msg, false) })
+	case msgReact:
+		c.inGame(func(g *Game) { g.handleReact(c, msg) })
+	case msgGetEvents:
+		c.inGame(func(g *Game) { g.handleGetEvents(c) })
+	case msgBack:
+		c.inGame(func(g *Game) { g.handleBack(c) })
+	case msgKick:
+		c.inGame(func(g *Game) { g.handleKick(c, msg, false) })
+	case msgBan:
+		c.inGame(func(g *Game) { g.handleKick(c, msg, true) })
+	case msgStateAck:
+		c.inGame(func(g *Game) { g.handleStateAck(c, msg) })
+	case msgGetState:
+		c.inGame(func(g *Game) { g.handleGetState(c) })
+	case msgResync:
+		c.handleResync()
+	case msgListGames:
+		c.sendGamesList(c.hub.lobbies.list())
+	case msgSubscribeLobbies:
+		c.hub.lobbies.subscribe(c)
+	case msgUnsubscribeLobbies:
+		c.hub.lobbies.unsubscribe(c)
+	default:
+		c.sendError("tipo desconocido: " + msg.Type)
+	}
+}
+
+// inGame ejecuta fn en el event loop de la partida del cliente y espera a que
+// termine, de modo que las respuestas (y el ack de un requestId) salen en orden.
+func (c *Client) inGame(fn func(g *Game)) {
+	g := c.game.Load()
+	if g == nil {
+		c.sendError(errNoGame)
+		return
+	}
+	if !g.call(func() { fn(g) }) {
+		c.sendError(errGameNotFound)
+	}
+}
+
+// writePump escribe los mensajes encolados y envía un ping cada
+// Cfg.PingInterval. Si una escritura no termina en Cfg.WriteWait, cierra la
+// conexión para que readPump falle y el cliente pase por Hub.unregister.
 func (c *Client) writePump() {
-	for message := range c.send {
-		if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
-			return
+	ticker := time.NewTicker(Cfg.PingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-c.send:
+			if !ok {
+				c.write(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.write(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-c.stateReady:
+		case <-ticker.C:
+			if err := c.write(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+
+		// El game_state coalescido se envía cuando la cola se ha vaciado, para
+		// no adelantarlo a mensajes encolados antes que él.
+		if message := c.takePendingState(); message != nil {
+			if err := c.write(websocket.TextMessage, message); err != nil {
+				return
+			}
 		}
 	}
 }
 
+func (c *Client) write(messageType int, data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(Cfg.WriteWait))
+	return c.conn.WriteMessage(messageType, data)
+}
+
 func (c *Client) sendJSON(v any) {
 	data, err := json.Marshal(v)
 	if err != nil {
 		return
 	}
-	select {
-	case c.send <- data:
-	default:
-		log.Println("Canal lleno, no se pudo enviar")
-	}
+	c.sendRaw(data)
+}
+
+func (c *Client) sendRaw(data []byte) {
+	c.enqueue(data, false)
 }
 
+// sendState encola un game_state (completo o parche). Si la conexión va
+// retrasada, se coalesce con el game_state pendiente en lugar de perderse.
+func (c *Client) sendState(data []byte) {
+	c.enqueue(data, true)
+}
+
+// sendError responde con un error al mensaje que está procesando readPump y,
+// si llevaba requestId, lo correlaciona y lo guarda como respuesta. Solo puede
+// llamarse mientras se procesa un mensaje del propio cliente.
 func (c *Client) sendError(msg string) {
+	if c.requestID == "" {
+		c.sendAsyncError(msg)
+		return
+	}
+	data, err := json.Marshal(map[string]string{jsonKeyType: msgError, jsonKeyMsg: msg, jsonKeyRequest: c.requestID})
+	if err != nil {
+		return
+	}
+	if c.requestReply == nil {
+		c.requestReply = data
+	}
+	c.sendRaw(data)
+}
+
+// sendAsyncError envía un error que no responde a ningún mensaje del cliente
+// (por ejemplo, desde el matchmaker). No toca requestID ni requestReply, así
+// que puede llamarse desde cualquier goroutine.
+func (c *Client) sendAsyncError(msg string) {
 	c.sendJSON(map[string]string{jsonKeyType: msgError, jsonKeyMsg: msg})
 }
 
 func (c *Client) handleCreate(msg InMessage) {
-	code := generateGameCode()
+	// Las opciones se validan como en update_config, antes de salir de nada
+	if msg.MaxPlayers != 0 && !validMaxPlayers(msg.MaxPlayers) {
+		c.sendError(errInvalidMaxPlayers)
+		return
+	}
+	if !validTurnTimer(msg) {
+		c.sendError(errInvalidTurnTimer)
+		return
+	}
+
+	// Un cliente solo puede estar en una partida: sale de la cola y de la anterior
+	c.hub.matchmaker.dequeue(c, queueLeft)
+	c.leaveGame()
+	if c.createGame(msg) == nil {
+		c.sendError(errNoGameCode)
+	}
+}
+
+// createGame crea una partida con el cliente como anfitrión (asiento 0), la
+// registra en el Hub y arranca su event loop. Las opciones de msg deben venir
+// ya validadas (ver handleCreate). Si no encuentra un código libre devuelve nil
+// sin responder al cliente: el error lo envía quien la llama.
+func (c *Client) createGame(msg InMessage) *Game {
 	name := msg.PlayerName
 	if name == "" {
 		name = "Jugador 1"
@@ -405,48 +740,147 @@ func (c *Client) handleCreate(msg InMessage) {
 	if victoryScore < Cfg.MinVictoryScore || victoryScore > Cfg.MaxVictoryScore {
 		victoryScore = Cfg.DefaultVictoryScore
 	}
-	g := &Game{
-		code:                   code,
-		clients:                make([]*Client, Cfg.NumPlayers),
-		playerNames:            make([]string, Cfg.NumPlayers),
-		totals:                 make([]int, Cfg.NumPlayers),
-		victoryScore:           victoryScore,
-		bonusAfterSecondHotDice: msg.BonusAfterSecondHotDice,
-		finalRoundTriggerIndex: invalidIndex,
-		finalRoundPlayedExtra:  make([]bool, Cfg.NumPlayers),
-		winnerIndex:            invalidIndex,
+	maxPlayers := msg.MaxPlayers
+	if maxPlayers == 0 {
+		maxPlayers = Cfg.NumPlayers
+	}
+	g := newGame(c.hub, "", maxPlayers)
+	g.victoryScore = victoryScore
+	g.bonusAfterSecondHotDice = msg.BonusAfterSecondHotDice
+	g.public = msg.Public
+	if msg.Password != nil {
+		g.setPassword(*msg.Password)
+	}
+	if msg.MinPlayers != 0 {
+		g.setMinPlayers(msg.MinPlayers)
+	}
+	if msg.AllowSpectators != nil {
+		g.allowSpectators = *msg.AllowSpectators
 	}
+	g.setTurnTimer(msg)
 	g.clients[0] = c
 	g.playerNames[0] = name
-	c.gameCode = code
-	c.playerIndex = 0
+	g.resumeTokens[0] = newResumeToken()
 
-	c.hub.mu.Lock()
-	c.hub.games[code] = g
-	c.hub.mu.Unlock()
+	if !c.hub.addGame(g) {
+		log.Println("No se ha encontrado un código de partida libre")
+		return nil
+	}
+	c.game.Store(g)
+	g.publishLobby()
+	go g.run()
 
 	gamesCreatedTotal.Inc()
 	activeGames.Inc()
 
-	c.sendJSON(map[string]any{jsonKeyType: msgGameCreated, jsonKeyGameCode: code})
+	c.sendJSON(map[string]any{
+		jsonKeyType:     msgGameCreated,
+		jsonKeyGameCode: g.code,
+		jsonKeyResume:   g.resumeTokens[0],
+	})
+	return g
 }
 
-func (c *Client) handleJoin(msg InMessage) {
+// findGame busca la partida msg.GameCode para join o spectate. Responde con
+// el error correspondiente y devuelve nil si no hay código, si no existe o si
+// la conexión está frenada por probar demasiados códigos inexistentes.
+func (c *Client) findGame(msg InMessage) *Game {
 	if msg.GameCode == "" {
 		c.sendError(errGameCodeRequired)
-		return
+		return nil
 	}
 
-	c.hub.mu.Lock()
-	g, ok := c.hub.games[msg.GameCode]
-	c.hub.mu.Unlock()
+	// Una conexión que falla muchos códigos seguidos está probando códigos al
+	// azar: se le frena hasta que recupere intentos.
+	now := time.Now()
+	if c.joinMisses != nil {
+		if wait := c.joinMisses.wait(now); wait > 0 {
+			rateLimitedTotal.WithLabelValues(rateLimitJoinProbe).Inc()
+			c.sendRateLimited(msg, wait)
+			return nil
+		}
+	}
 
+	g, ok := c.hub.game(msg.GameCode)
 	if !ok {
+		if c.joinMisses == nil {
+			c.joinMisses = newTokenBucket(Cfg.JoinMissRate, now)
+		}
+		c.joinMisses.allow(now)
+		if c.joinMisses.wait(now) > 0 {
+			log.Printf("Posible búsqueda de códigos de partida desde %s", c.ip)
+		}
+		c.sendError(errGameNotFound)
+		return nil
+	}
+	return g
+}
+
+func (c *Client) handleJoin(msg InMessage) {
+	g := c.findGame(msg)
+	if g == nil {
+		return
+	}
+
+	// Un cliente solo puede estar en una partida: sale de la cola y, solo si
+	// la nueva partida lo admite, de la anterior. Si vuelve a pedir la misma,
+	// la partida lo rechaza.
+	c.hub.matchmaker.dequeue(c, queueLeft)
+	previous := c.game.Load()
+
+	joined := false
+	if !g.call(func() { joined = g.handleJoin(c, msg) }) {
 		c.sendError(errGameNotFound)
 		return
 	}
+	if !joined {
+		return
+	}
+	c.game.Store(g)
+	if previous != nil && previous != g {
+		c.leave(previous)
+	}
+}
 
-	// Buscar el primer hueco libre para este jugador
+// handleJoin sienta al cliente en el primer asiento libre o, con un
+// resumeToken, en el asiento que dejó al desconectarse. Una vez empezada la
+// partida solo se admite volver con resumeToken. Devuelve false si no ha
+// podido sentarlo.
+func (g *Game) handleJoin(c *Client, msg InMessage) bool {
+	if g.seatOf(c) >= 0 {
+		c.sendError(errAlreadyInGame)
+		return false
+	}
+	if g.isBanned(c) {
+		c.sendError(errBanned)
+		return false
+	}
+	if msg.ResumeToken != "" {
+		return g.handleResume(c, msg.ResumeToken)
+	}
+	if g.gameStarted {
+		c.sendError(errGameAlreadyStarted)
+		return false
+	}
+	password := ""
+	if msg.Password != nil {
+		password = *msg.Password
+	}
+	if !g.checkJoinPassword(c, password) {
+		return false
+	}
+
+	if !g.seatPlayer(c, msg.PlayerName) {
+		c.sendError(errGameFull)
+		return false
+	}
+	return true
+}
+
+// seatPlayer sienta al cliente en el primer asiento libre y se lo comunica a
+// la mesa. No comprueba si el cliente puede entrar ni responde con errores:
+// devuelve false si la mesa está llena.
+func (g *Game) seatPlayer(c *Client, name string) bool {
 	slot := -1
 	for i := 0; i < len(g.clients); i++ {
 		if g.clients[i] == nil {
@@ -455,100 +889,212 @@ func (c *Client) handleJoin(msg InMessage) {
 		}
 	}
 	if slot == -1 {
-		c.sendError(errGameFull)
-		return
+		return false
 	}
 
 	g.clients[slot] = c
-	c.gameCode = msg.GameCode
-	c.playerIndex = slot
+	g.ready[slot] = false
+	delete(g.stateAcks, c)
+	// Un espectador que se sienta deja de ser espectador
+	delete(g.spectators, c)
 
-	name := msg.PlayerName
 	if name == "" {
 		name = "Jugador " + strconv.Itoa(slot+1)
 	}
 	g.playerNames[slot] = name
+	g.resumeTokens[slot] = newResumeToken()
 
 	gamesJoinedTotal.Inc()
 
 	c.sendJSON(map[string]any{
 		jsonKeyType:     msgGameJoined,
-		jsonKeyGameCode: msg.GameCode,
+		jsonKeyGameCode: g.code,
+		jsonKeyResume:   g.resumeTokens[slot],
 		"playerIndex":   slot,
 	})
 
-	c.hub.broadcastToGame(msg.GameCode, map[string]any{
+	g.broadcast(map[string]any{
 		jsonKeyType:   msgPlayerJoined,
 		"playerIndex": slot,
 		"playerName":  name,
 	})
 
 	// Actualizar el estado para todos los jugadores tras la incorporación
-	c.hub.broadcastGameState(msg.GameCode)
+	g.broadcastState()
+	g.sendChatHistory(c)
+	return true
 }
 
-// handleStartGame marca el inicio de la partida a nivel de lobby,
-// notificando a todos los jugadores que pueden abandonar el lobby.
-func (c *Client) handleStartGame(msg InMessage) {
-	if c.gameCode == "" {
+// handleResume vuelve a sentar a un jugador desconectado en su asiento,
+// conservando su nombre y su puntuación. El token se renueva en cada uso.
+func (g *Game) handleResume(c *Client, token string) bool {
+	slot := -1
+	for i, t := range g.resumeTokens {
+		if g.clients[i] == nil && t != "" && subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			slot = i
+			break
+		}
+	}
+	if slot == -1 {
+		c.sendError(errInvalidResumeToken)
+		return false
+	}
+
+	g.clients[slot] = c
+	delete(g.stateAcks, c)
+	g.resumeTokens[slot] = newResumeToken()
+	// La readPump de c espera a que termine este comando, así que se puede tocar su caché
+	c.requests.merge(g.seatRequests[slot])
+	g.seatRequests[slot] = requestCache{}
+
+	c.sendJSON(map[string]any{
+		jsonKeyType:     msgGameJoined,
+		jsonKeyGameCode: g.code,
+		jsonKeyResume:   g.resumeTokens[slot],
+		"playerIndex":   slot,
+	})
+
+	g.broadcast(map[string]any{
+		jsonKeyType:   msgPlayerJoined,
+		"playerIndex": slot,
+		"playerName":  g.playerNames[slot],
+		"resumed":     true,
+	})
+	g.broadcastState()
+	g.sendChatHistory(c)
+	return true
+}
+
+func (c *Client) handleLeave() {
+	if c.game.Load() == nil {
 		c.sendError(errNoGame)
 		return
 	}
+	c.leaveGame()
+}
 
-	c.hub.mu.RLock()
-	g, ok := c.hub.games[c.gameCode]
-	c.hub.mu.RUnlock()
-	if !ok {
-		c.sendError(errGameNotFound)
+// leaveGame saca al cliente de su partida actual, si tiene alguna, y le
+// confirma la salida con left_game. La conexión sigue abierta sin partida.
+func (c *Client) leaveGame() {
+	g := c.game.Load()
+	if g == nil {
 		return
 	}
+	c.game.Store(nil)
+	c.leave(g)
+}
+
+// leave saca al cliente de la partida g y le confirma la salida con left_game.
+func (c *Client) leave(g *Game) {
+	g.call(func() { g.handleLeave(c) })
+	c.sendJSON(map[string]any{jsonKeyType: msgLeftGame, jsonKeyGameCode: g.code})
+}
+
+// handleLeave libera el asiento de un jugador que abandona la partida con la
+// misma lógica que una desconexión, pero avisando con player_left. A
+// diferencia de una desconexión, el asiento ya no se puede recuperar.
+func (g *Game) handleLeave(c *Client) {
+	seat := g.seatOf(c)
+	if seat < 0 {
+		g.removeSpectator(c)
+		return
+	}
+	g.resumeTokens[seat] = ""
+	g.removePlayer(seat, msgPlayerLeft)
+}
 
-	g.mu.Lock()
-	isCreator := c.playerIndex == 0
-	if isCreator {
-		g.gameStarted = true
+// handleStartGame marca el inicio de la partida a nivel de lobby,
+// notificando a todos los jugadores que pueden abandonar el lobby.
+func (g *Game) handleStartGame(c *Client, msg InMessage) {
+	seat := g.seatOf(c)
+	if seat < 0 {
+		g.sendNotSeated(c)
+		return
 	}
-	g.mu.Unlock()
 
-	if !isCreator {
+	if seat != g.host {
 		c.sendError("Only the creator can start the game")
 		return
 	}
+	if g.gameStarted {
+		c.sendError(errGameAlreadyStarted)
+		return
+	}
+	if g.winnerIndex >= 0 {
+		c.sendError(errGameFinished)
+		return
+	}
+
+	seated := 0
+	for i, other := range g.clients {
+		if other == nil {
+			continue
+		}
+		seated++
+		if !g.ready[i] {
+			c.sendError(errPlayersNotReady)
+			return
+		}
+	}
+	if seated < g.minPlayers {
+		c.sendError(errNotEnoughPlayers)
+		return
+	}
+	if !g.applyTurnOrder(msg.TurnOrder) {
+		c.sendError(errInvalidTurnOrder)
+		return
+	}
+	g.startGame()
+}
+
+// startGame empieza la partida con el orden de turnos ya aplicado. No
+// comprueba si se puede empezar (ver handleStartGame).
+func (g *Game) startGame() {
+	g.gameStarted = true
+	g.resetClocks()
+	g.startTurnTimer()
 
 	// Notificar a todos los jugadores en la partida que el juego ha empezado
-	c.hub.broadcastToGame(c.gameCode, map[string]any{
+	g.broadcast(map[string]any{
 		jsonKeyType: msgGameStarted,
+		"turnOrder": g.seatedTurnOrder(),
 	})
+	g.broadcastState()
 }
 
-// handleRestartGame reinicia una partida ya terminada en la misma sala,
-// manteniendo jugadores y configuración pero reseteando puntuaciones y estado.
-func (c *Client) handleRestartGame(msg InMessage) {
-	if c.gameCode == "" {
-		c.sendError(errNoGame)
+// handleReady cambia el estado "listo" del jugador en el lobby. La partida
+// solo puede empezar cuando todos los jugadores sentados están listos.
+func (g *Game) handleReady(c *Client) {
+	seat := g.seatOf(c)
+	if seat < 0 {
+		g.sendNotSeated(c)
 		return
 	}
-
-	c.hub.mu.RLock()
-	g, ok := c.hub.games[c.gameCode]
-	c.hub.mu.RUnlock()
-	if !ok {
-		c.sendError(errGameNotFound)
+	if g.gameStarted {
+		c.sendError(errGameAlreadyStarted)
 		return
 	}
+	g.ready[seat] = !g.ready[seat]
+	g.broadcastState()
+}
 
-	g.mu.Lock()
+// handleRestartGame reinicia una partida ya terminada en la misma sala,
+// manteniendo jugadores y configuración pero reseteando puntuaciones y estado.
+func (g *Game) handleRestartGame(c *Client, msg InMessage) {
+	seat := g.seatOf(c)
+	if seat < 0 {
+		g.sendNotSeated(c)
+		return
+	}
 
-	// Solo el creador puede reiniciar la partida
-	if c.playerIndex != 0 {
-		g.mu.Unlock()
+	// Solo el anfitrión puede reiniciar la partida
+	if seat != g.host {
 		c.sendError("Only the creator can restart the game")
 		return
 	}
 
 	// Solo se puede reiniciar si la partida ha terminado
 	if g.winnerIndex < 0 {
-		g.mu.Unlock()
 		c.sendError("Game is not finished yet")
 		return
 	}
@@ -558,13 +1104,9 @@ func (c *Client) handleRestartGame(msg InMessage) {
 		g.totals[i] = 0
 	}
 
-	g.dice = nil
-	g.selectedIndices = nil
-	g.turnPoints = 0
-	g.turnMoves = nil
-	g.hasApartadoThisRoll = false
-	g.hotDiceCountThisTurn = 0
-	g.lastHotDiceBonus = 0
+	g.resetTurn()
+	g.resetClocks()
+	g.resetAFK()
 	g.finalRoundTriggerIndex = invalidIndex
 	g.finalRoundPlayedExtra = make([]bool, len(g.clients))
 	g.winnerIndex = invalidIndex
@@ -575,34 +1117,23 @@ func (c *Client) handleRestartGame(msg InMessage) {
 	if g.currentPlayerIndex < 0 {
 		g.currentPlayerIndex = 0
 	}
-
-	g.mu.Unlock()
+	g.startTurnTimer()
 
 	// Enviar nuevo estado de juego (status: playing) a todos los clientes
-	c.hub.broadcastGameState(c.gameCode)
+	g.broadcastState()
 }
 
 // handleUpdateConfig permite al creador actualizar la configuración de la partida
 // antes de que empiece (por ahora solo victoryScore).
-func (c *Client) handleUpdateConfig(msg InMessage) {
-	if c.gameCode == "" {
-		c.sendError(errNoGame)
-		return
-	}
-
-	c.hub.mu.RLock()
-	g, ok := c.hub.games[c.gameCode]
-	c.hub.mu.RUnlock()
-	if !ok {
-		c.sendError(errGameNotFound)
+func (g *Game) handleUpdateConfig(c *Client, msg InMessage) {
+	seat := g.seatOf(c)
+	if seat < 0 {
+		g.sendNotSeated(c)
 		return
 	}
 
-	g.mu.Lock()
-	defer g.mu.Unlock()
-
-	// Solo el creador puede cambiar la configuración
-	if c.playerIndex != 0 {
+	// Solo el anfitrión puede cambiar la configuración
+	if seat != g.host {
 		c.sendError("Only the creator can change game settings")
 		return
 	}
@@ -613,6 +1144,16 @@ func (c *Client) handleUpdateConfig(msg InMessage) {
 		return
 	}
 
+	// Solo se puede reducir la mesa si no deja fuera a nadie sentado
+	if msg.MaxPlayers != 0 && !g.canResize(msg.MaxPlayers) {
+		c.sendError(errInvalidMaxPlayers)
+		return
+	}
+	if !validTurnTimer(msg) {
+		c.sendError(errInvalidTurnTimer)
+		return
+	}
+
 	victoryScore := msg.VictoryScore
 	if victoryScore < Cfg.MinVictoryScore || victoryScore > Cfg.MaxVictoryScore {
 		victoryScore = Cfg.DefaultVictoryScore
@@ -620,140 +1161,56 @@ func (c *Client) handleUpdateConfig(msg InMessage) {
 
 	g.victoryScore = victoryScore
 	g.bonusAfterSecondHotDice = msg.BonusAfterSecondHotDice
-	g.hotDiceCountThisTurn = 0
-	g.lastHotDiceBonus = 0
-
-	// Notificar el nuevo estado a todos los jugadores en el lobby
-	go c.hub.broadcastGameState(c.gameCode)
-}
-
-func (h *Hub) broadcastToGame(gameCode string, payload any) {
-	h.mu.RLock()
-	g, ok := h.games[gameCode]
-	h.mu.RUnlock()
-	if !ok {
-		return
+	if msg.Password != nil {
+		g.setPassword(*msg.Password)
 	}
-
-	data, _ := json.Marshal(payload)
-	for _, client := range g.clients {
-		if client != nil {
-			select {
-			case client.send <- data:
-			default:
-				log.Println("No se pudo enviar a un jugador, canal lleno")
-			}
-		}
+	if msg.MaxPlayers != 0 {
+		g.resize(msg.MaxPlayers)
 	}
-}
-
-func (h *Hub) broadcastGameState(gameCode string) {
-	h.mu.RLock()
-	g, ok := h.games[gameCode]
-	h.mu.RUnlock()
-	if !ok {
-		return
-	}
-
-	g.mu.RLock()
-	defer g.mu.RUnlock()
-
-	players := make([]map[string]any, Cfg.NumPlayers)
-	for i := 0; i < Cfg.NumPlayers; i++ {
-		active := i < len(g.clients) && g.clients[i] != nil
-		name := ""
-		total := 0
-		if active {
-			if i < len(g.playerNames) && g.playerNames[i] != "" {
-				name = g.playerNames[i]
-			} else {
-				name = "Jugador " + strconv.Itoa(i+1)
-			}
-			if i < len(g.totals) {
-				total = g.totals[i]
-			}
-		}
-		players[i] = map[string]any{
-			"name":   name,
-			"total":  total,
-			"active": active,
-		}
+	if msg.MinPlayers != 0 {
+		g.setMinPlayers(msg.MinPlayers)
 	}
-
-	remainingCount := 0
-	for _, d := range g.dice {
-		if !d.Held {
-			remainingCount++
-		}
+	if msg.AllowSpectators != nil {
+		g.allowSpectators = *msg.AllowSpectators
 	}
+	g.setTurnTimer(msg)
+	g.hotDiceCountThisTurn = 0
+	g.lastHotDiceBonus = 0
 
-	status := "playing"
-	if g.winnerIndex >= 0 {
-		status = "finished"
-	}
-	turnMoves := g.turnMoves
-	if turnMoves == nil {
-		turnMoves = []TurnMove{}
-	}
-	gameHistory := g.gameHistory
-	if gameHistory == nil {
-		gameHistory = []map[string]any{}
-	}
-	state := map[string]any{
-		jsonKeyType:               msgGameState,
-		"players":                 players,
-		"gameStarted":             g.gameStarted,
-		"bonusAfterSecondHotDice": g.bonusAfterSecondHotDice,
-		"currentPlayerIndex":      g.currentPlayerIndex,
-		"dice":                    g.dice,
-		"selectedIndices":         g.selectedIndices,
-		"remainingDiceCount":      remainingCount,
-		"turnPoints":              g.turnPoints,
-		"turnMoves":               turnMoves,
-		"victoryScore":            g.victoryScore,
-		"finalRoundTriggerIndex":  g.finalRoundTriggerIndex,
-		"winnerIndex":             g.winnerIndex,
-		"status":                  status,
-		"gameHistory":             gameHistory,
-	}
-	h.broadcastToGame(gameCode, state)
+	// Notificar el nuevo estado a todos los jugadores en el lobby
+	g.broadcastState()
 }
 
-func (c *Client) handleRoll() {
+func (g *Game) handleRoll(c *Client) {
 	start := time.Now()
 	defer func() {
 		rollDuration.Observe(time.Since(start).Seconds())
 	}()
 
-	if c.gameCode == "" {
-		c.sendError(errNoGame)
+	seat := g.seatOf(c)
+	if seat < 0 {
+		g.sendNotSeated(c)
 		return
 	}
 
-	c.hub.mu.RLock()
-	g, ok := c.hub.games[c.gameCode]
-	c.hub.mu.RUnlock()
-	if !ok {
-		c.sendError(errGameNotFound)
+	if !g.gameStarted {
+		c.sendError(errGameNotStarted)
 		return
 	}
-
-	g.mu.Lock()
 	if g.winnerIndex >= 0 {
-		g.mu.Unlock()
 		c.sendError(errGameFinished)
 		return
 	}
-	if g.currentPlayerIndex != c.playerIndex {
-		g.mu.Unlock()
+	if g.currentPlayerIndex != seat {
 		c.sendError(errNotYourTurn)
 		return
 	}
 	if len(g.dice) > 0 && !g.hasApartadoThisRoll {
-		g.mu.Unlock()
 		c.sendError(errRollWithoutApartar)
 		return
 	}
+	g.clearAFK(seat)
+	g.undoStack = nil
 
 	var activeValues []int
 	if len(g.dice) == 0 {
@@ -779,118 +1236,47 @@ func (c *Client) handleRoll() {
 	}
 	g.selectedIndices = nil
 	g.hasApartadoThisRoll = false
-	g.mu.Unlock()
 
-	c.hub.broadcastToGame(c.gameCode, map[string]any{jsonKeyType: msgRollResult, "dice": g.dice})
+	g.broadcast(map[string]any{jsonKeyType: msgRollResult, "dice": g.dice})
 
 	// Farkle: si no hay ninguna combinación puntuable en los dados activos, pierde los puntos del turno
 	if !HasAnyScoringOption(activeValues) {
 		farklesTotal.Inc()
-		g.mu.Lock()
-		finishedIndex := g.currentPlayerIndex
-		g.turnPoints = 0
-		g.turnMoves = nil
-		g.dice = nil
-		g.selectedIndices = nil
-		g.hotDiceCountThisTurn = 0
-		g.lastHotDiceBonus = 0
-
-		// Pasar turno al siguiente jugador activo, si lo hay
-		next := g.nextActivePlayerIndex(g.currentPlayerIndex)
-		g.currentPlayerIndex = next
-
-		// Si la ronda final estaba activa, marcar el turno extra del jugador y comprobar si termina la partida
-		finalFinished := false
-		if g.finalRoundTriggerIndex >= 0 {
-			// El jugador que disparó la ronda final no cuenta como turno extra
-			if finishedIndex != g.finalRoundTriggerIndex && finishedIndex >= 0 && finishedIndex < len(g.finalRoundPlayedExtra) {
-				g.finalRoundPlayedExtra[finishedIndex] = true
-			}
+		g.broadcast(map[string]any{jsonKeyType: msgFarkle, jsonKeyMsg: "Farkle: pierdes los puntos del turno"})
 
-			allDone := true
-			for i := 0; i < len(g.clients); i++ {
-				if i == g.finalRoundTriggerIndex {
-					continue
-				}
-				if g.clients[i] != nil && !g.finalRoundPlayedExtra[i] {
-					allDone = false
-					break
-				}
-			}
-
-			if allDone {
-				// Calcular ganador por puntuación; en empate, favorece al jugador que disparó la ronda final
-				winner := -1
-				best := -1
-				for i := 0; i < len(g.totals); i++ {
-					if g.clients[i] == nil {
-						continue
-					}
-					if g.totals[i] > best {
-						best = g.totals[i]
-						winner = i
-					} else if g.totals[i] == best && best >= 0 {
-						if winner != g.finalRoundTriggerIndex && i == g.finalRoundTriggerIndex {
-							winner = i
-						}
-					}
-				}
-				if winner >= 0 {
-					g.winnerIndex = winner
-					g.finishedAt = time.Now()
-					g.turnMoves = nil
-					g.appendFinishedGameToHistory()
-					finalFinished = true
-				}
-			}
-		}
-
-		if finalFinished {
-			g.mu.Unlock()
-			c.hub.broadcastToGame(c.gameCode, map[string]any{jsonKeyType: msgFarkle, jsonKeyMsg: "Farkle: pierdes los puntos del turno"})
-			c.hub.broadcastToGame(c.gameCode, map[string]any{jsonKeyType: msgGameOver, jsonKeyWinner: g.winnerIndex, jsonKeyMsg: "Partida terminada"})
-			c.hub.broadcastGameState(c.gameCode)
-		} else {
-			g.mu.Unlock()
-			c.hub.broadcastToGame(c.gameCode, map[string]any{jsonKeyType: msgFarkle, jsonKeyMsg: "Farkle: pierdes los puntos del turno"})
+		// Pasar turno al siguiente jugador activo; en la ronda final puede terminar la partida
+		if g.passTurn(g.currentPlayerIndex) {
+			g.broadcast(map[string]any{jsonKeyType: msgGameOver, jsonKeyWinner: g.winnerIndex, jsonKeyMsg: "Partida terminada"})
 		}
 	}
 
-	c.hub.broadcastGameState(c.gameCode)
+	g.broadcastState()
 }
 
-func (c *Client) handleToggleSelect(msg InMessage) {
-	if c.gameCode == "" {
-		c.sendError(errNoGame)
+func (g *Game) handleToggleSelect(c *Client, msg InMessage) {
+	seat := g.seatOf(c)
+	if seat < 0 {
+		g.sendNotSeated(c)
 		return
 	}
 
-	c.hub.mu.RLock()
-	g, ok := c.hub.games[c.gameCode]
-	c.hub.mu.RUnlock()
-	if !ok {
-		c.sendError(errGameNotFound)
+	if !g.gameStarted {
+		c.sendError(errGameNotStarted)
 		return
 	}
-
-	g.mu.Lock()
 	if g.winnerIndex >= 0 {
-		g.mu.Unlock()
 		c.sendError(errGameFinished)
 		return
 	}
-	if g.currentPlayerIndex != c.playerIndex {
-		g.mu.Unlock()
+	if g.currentPlayerIndex != seat {
 		c.sendError(errNotYourTurn)
 		return
 	}
 	if msg.Index < 0 || msg.Index >= len(g.dice) {
-		g.mu.Unlock()
 		c.sendError(errInvalidIndex)
 		return
 	}
 	if g.dice[msg.Index].Held {
-		g.mu.Unlock()
 		c.sendError(errSelectHeldDie)
 		return
 	}
@@ -908,66 +1294,84 @@ func (c *Client) handleToggleSelect(msg InMessage) {
 		g.selectedIndices = append(g.selectedIndices, msg.Index)
 	}
 
-	g.mu.Unlock()
-	c.hub.broadcastGameState(c.gameCode)
+	g.broadcastState()
 }
 
-func (c *Client) handleApartar() {
-	if c.gameCode == "" {
-		c.sendError(errNoGame)
-		return
+// handleApartar aparta los dados seleccionados, o los de msg.Values si vienen
+// en el mensaje (índices de dados, sin pasar por toggle_select).
+func (g *Game) handleApartar(c *Client, msg InMessage) {
+	if g.setAside(c, msg.Values) {
+		g.broadcastState()
 	}
+}
 
-	c.hub.mu.RLock()
-	g, ok := c.hub.games[c.gameCode]
-	c.hub.mu.RUnlock()
-	if !ok {
-		c.sendError(errGameNotFound)
-		return
+// setAside aparta los dados de indices (o los seleccionados si indices está
+// vacío) y suma sus puntos al turno, sin emitir el estado. Todo se valida antes
+// de cambiar nada: si la selección no es válida no se aparta ningún dado y
+// devuelve false.
+func (g *Game) setAside(c *Client, indices []int) bool {
+	seat := g.seatOf(c)
+	if seat < 0 {
+		g.sendNotSeated(c)
+		return false
 	}
 
-	g.mu.Lock()
+	if !g.gameStarted {
+		c.sendError(errGameNotStarted)
+		return false
+	}
 	if g.winnerIndex >= 0 {
-		g.mu.Unlock()
 		c.sendError(errGameFinished)
-		return
+		return false
 	}
-	if g.currentPlayerIndex != c.playerIndex {
-		g.mu.Unlock()
+	if g.currentPlayerIndex != seat {
 		c.sendError(errNotYourTurn)
-		return
+		return false
 	}
 	if len(g.dice) == 0 {
-		g.mu.Unlock()
 		c.sendError(errRollFirst)
-		return
+		return false
+	}
+	selected := g.selectedIndices
+	if len(indices) > 0 {
+		seen := make(map[int]bool, len(indices))
+		for _, idx := range indices {
+			if idx < 0 || idx >= len(g.dice) || seen[idx] {
+				c.sendError(errInvalidIndex)
+				return false
+			}
+			if g.dice[idx].Held {
+				c.sendError(errSelectHeldDie)
+				return false
+			}
+			seen[idx] = true
+		}
+		selected = indices
 	}
-	if len(g.selectedIndices) == 0 {
-		g.mu.Unlock()
+	if len(selected) == 0 {
 		c.sendError(errSelectBeforeApart)
-		return
+		return false
 	}
 
 	// Obtener valores de los dados seleccionados (solo los no held)
-	pickedValues := make([]int, 0, len(g.selectedIndices))
-	for _, idx := range g.selectedIndices {
+	pickedValues := make([]int, 0, len(selected))
+	for _, idx := range selected {
 		if idx >= 0 && idx < len(g.dice) && !g.dice[idx].Held {
 			pickedValues = append(pickedValues, g.dice[idx].Value)
 		}
 	}
 	if len(pickedValues) == 0 {
-		g.mu.Unlock()
 		c.sendError(errSelectNotHeld)
-		return
+		return false
 	}
 
 	valid, points := ScoreSelection(pickedValues)
 	if !valid {
-		g.mu.Unlock()
 		c.sendError(errInvalidSelection)
-		return
+		return false
 	}
 
+	g.pushSetAsideUndo()
 	g.turnPoints += points
 	g.hasApartadoThisRoll = true
 	g.turnMoves = append(g.turnMoves, TurnMove{
@@ -977,7 +1381,7 @@ func (c *Client) handleApartar() {
 	})
 
 	// Marcar los dados seleccionados como held (apartados)
-	for _, idx := range g.selectedIndices {
+	for _, idx := range selected {
 		if idx >= 0 && idx < len(g.dice) {
 			g.dice[idx].Held = true
 		}
@@ -1019,47 +1423,35 @@ func (c *Client) handleApartar() {
 		}
 
 		g.dice = nil
-		g.mu.Unlock()
-		c.hub.broadcastToGame(c.gameCode, map[string]any{
+		g.broadcast(map[string]any{
 			jsonKeyType:  msgHotDice,
 			jsonKeyMsg:   "¡Mano limpia! Puedes volver a tirar los 6 dados",
 			"hotDiceBonus": bonusApplied,
 		})
-		c.hub.broadcastGameState(c.gameCode)
-		return
 	}
-
-	g.mu.Unlock()
-	c.hub.broadcastGameState(c.gameCode)
+	return true
 }
 
-func (c *Client) handleBank() {
-	if c.gameCode == "" {
-		c.sendError(errNoGame)
+func (g *Game) handleBank(c *Client) {
+	seat := g.seatOf(c)
+	if seat < 0 {
+		g.sendNotSeated(c)
 		return
 	}
 
-	c.hub.mu.RLock()
-	g, ok := c.hub.games[c.gameCode]
-	c.hub.mu.RUnlock()
-	if !ok {
-		c.sendError(errGameNotFound)
+	if !g.gameStarted {
+		c.sendError(errGameNotStarted)
 		return
 	}
-
-	g.mu.Lock()
 	if g.winnerIndex >= 0 {
-		g.mu.Unlock()
 		c.sendError(errGameFinished)
 		return
 	}
-	if g.currentPlayerIndex != c.playerIndex {
-		g.mu.Unlock()
+	if g.currentPlayerIndex != seat {
 		c.sendError(errNotYourTurn)
 		return
 	}
 	if g.turnPoints <= 0 {
-		g.mu.Unlock()
 		c.sendError(errBankNoPoints)
 		return
 	}
@@ -1071,13 +1463,52 @@ func (c *Client) handleBank() {
 		}
 	}
 	if hasActiveDice && !g.hasApartadoThisRoll {
-		g.mu.Unlock()
 		c.sendError(errBankMustApartar)
 		return
 	}
 
-	finishedIndex := c.playerIndex
-	g.totals[c.playerIndex] += g.turnPoints
+	g.bankTurn(seat)
+}
+
+// bankTurn suma los puntos del turno al total del jugador y pasa el turno. Si
+// el jugador alcanza la puntuación de victoria empieza la ronda final.
+func (g *Game) bankTurn(seat int) {
+	g.totals[seat] += g.turnPoints
+	finalRound := false
+	if g.finalRoundTriggerIndex == invalidIndex && g.totals[seat] >= g.victoryScore {
+		g.finalRoundTriggerIndex = seat
+		g.finalRoundPlayedExtra = make([]bool, len(g.clients))
+		finalRound = true
+	}
+
+	switch {
+	case g.passTurn(seat):
+		g.broadcast(map[string]any{
+			jsonKeyType:   msgGameOver,
+			jsonKeyWinner: g.winnerIndex,
+			jsonKeyMsg:    "Partida terminada",
+		})
+	case finalRound:
+		g.broadcast(map[string]any{
+			jsonKeyType: msgFinalRound,
+			jsonKeyMsg:  "Ronda final para el otro jugador",
+		})
+	default:
+		nextPlayer := g.currentPlayerIndex
+		nextName := "Jugador " + strconv.Itoa(nextPlayer+1)
+		if nextPlayer < len(g.playerNames) && g.playerNames[nextPlayer] != "" {
+			nextName = g.playerNames[nextPlayer]
+		}
+		g.broadcast(map[string]any{
+			jsonKeyType: msgTurnChanged,
+			jsonKeyMsg:  "Turno de " + nextName,
+		})
+	}
+	g.broadcastState()
+}
+
+// resetTurn descarta el estado del turno en curso: dados, selección y puntos.
+func (g *Game) resetTurn() {
 	g.turnPoints = 0
 	g.turnMoves = nil
 	g.dice = nil
@@ -1085,85 +1516,52 @@ func (c *Client) handleBank() {
 	g.hasApartadoThisRoll = false
 	g.hotDiceCountThisTurn = 0
 	g.lastHotDiceBonus = 0
+	g.undoStack = nil
+}
 
-	if g.finalRoundTriggerIndex == invalidIndex && g.totals[c.playerIndex] >= g.victoryScore {
-		g.finalRoundTriggerIndex = c.playerIndex
-		g.finalRoundPlayedExtra = make([]bool, len(g.clients))
-		g.currentPlayerIndex = g.nextActivePlayerIndex(g.currentPlayerIndex)
-		g.mu.Unlock()
-		c.hub.broadcastToGame(c.gameCode, map[string]any{
-			jsonKeyType: msgFinalRound,
-			jsonKeyMsg:  "Ronda final para el otro jugador",
-		})
-		c.hub.broadcastGameState(c.gameCode)
-		return
-	}
+// passTurn termina el turno de finished y pasa el turno al siguiente jugador
+// activo. Si la ronda final está en marcha, marca el turno extra del jugador y
+// comprueba si ya han jugado todos; en ese caso fija el ganador y devuelve true.
+func (g *Game) passTurn(finished int) bool {
+	g.resetTurn()
+	g.currentPlayerIndex = g.nextActivePlayerIndex(g.currentPlayerIndex)
+	defer g.startTurnTimer()
 
-	nextPlayer := g.nextActivePlayerIndex(g.currentPlayerIndex)
-	g.currentPlayerIndex = nextPlayer
-	nextName := "Jugador " + strconv.Itoa(nextPlayer+1)
-	if nextPlayer < len(g.playerNames) && g.playerNames[nextPlayer] != "" {
-		nextName = g.playerNames[nextPlayer]
+	if g.finalRoundTriggerIndex < 0 {
+		return false
 	}
-
-	// Si la ronda final ya estaba activa, marcar el turno extra del jugador y comprobar si termina la partida
-	finalFinished := false
-	if g.finalRoundTriggerIndex >= 0 {
-		if finishedIndex != g.finalRoundTriggerIndex && finishedIndex >= 0 && finishedIndex < len(g.finalRoundPlayedExtra) {
-			g.finalRoundPlayedExtra[finishedIndex] = true
+	// El jugador que disparó la ronda final no cuenta como turno extra
+	if finished != g.finalRoundTriggerIndex && finished >= 0 && finished < len(g.finalRoundPlayedExtra) {
+		g.finalRoundPlayedExtra[finished] = true
+	}
+	for i := 0; i < len(g.clients); i++ {
+		// Los ausentes no juegan su turno extra
+		if i != g.finalRoundTriggerIndex && g.contending(i) && !g.isAFK(i) && !g.finalRoundPlayedExtra[i] {
+			return false
 		}
+	}
 
-		allDone := true
-		for i := 0; i < len(g.clients); i++ {
-			if i == g.finalRoundTriggerIndex {
-				continue
-			}
-			if g.clients[i] != nil && !g.finalRoundPlayedExtra[i] {
-				allDone = false
-				break
-			}
+	// Calcular ganador por puntuación; en empate, favorece al jugador que disparó la ronda final
+	winner := -1
+	best := -1
+	for i := 0; i < len(g.totals); i++ {
+		if !g.contending(i) {
+			continue
 		}
-
-		if allDone {
-			winner := -1
-			best := -1
-			for i := 0; i < len(g.totals); i++ {
-				if g.clients[i] == nil {
-					continue
-				}
-				if g.totals[i] > best {
-					best = g.totals[i]
-					winner = i
-				} else if g.totals[i] == best && best >= 0 {
-					if winner != g.finalRoundTriggerIndex && i == g.finalRoundTriggerIndex {
-						winner = i
-					}
-				}
-			}
-			if winner >= 0 {
-				g.winnerIndex = winner
-				g.finishedAt = time.Now()
-				g.appendFinishedGameToHistory()
-				finalFinished = true
+		if g.totals[i] > best {
+			best = g.totals[i]
+			winner = i
+		} else if g.totals[i] == best && best >= 0 {
+			if winner != g.finalRoundTriggerIndex && i == g.finalRoundTriggerIndex {
+				winner = i
 			}
 		}
 	}
-
-	if finalFinished {
-		g.mu.Unlock()
-		c.hub.broadcastToGame(c.gameCode, map[string]any{
-			jsonKeyType:   msgGameOver,
-			jsonKeyWinner: g.winnerIndex,
-			jsonKeyMsg:    "Partida terminada",
-		})
-		c.hub.broadcastGameState(c.gameCode)
-		return
+	if winner < 0 {
+		return false
 	}
-
-	g.mu.Unlock()
-	c.hub.broadcastToGame(c.gameCode, map[string]any{
-		jsonKeyType: msgTurnChanged,
-		jsonKeyMsg:  "Turno de " + nextName,
-	})
-	c.hub.broadcastGameState(c.gameCode)
+	g.winnerIndex = winner
+	g.finishedAt = time.Now()
+	g.appendFinishedGameToHistory()
+	return true
 }
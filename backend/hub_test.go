@@ -0,0 +1,1023 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Tests de estrés del modelo de concurrencia. Están pensados para ejecutarse
+// con el detector de carreras: go test -race ./...
+
+// newTestClient crea un cliente sin conexión WebSocket, lo registra en el hub
+// y descarta en segundo plano todo lo que se le envía. Igual que readPump, cada
+// cliente solo debe usarse desde una goroutine.
+func newTestClient(h *Hub, ip string) *Client {
+	c := &Client{
+		hub:        h,
+		ip:         ip,
+		send:       make(chan []byte, Cfg.SendBufferSize),
+		stateReady: make(chan struct{}, 1),
+	}
+	h.register <- c
+	go func() {
+		for range c.send {
+		}
+	}()
+	return c
+}
+
+func startTestHub(t *testing.T) *Hub {
+	t.Helper()
+	h := newHub()
+	go h.run()
+	return h
+}
+
+// waitFor espera a que cond se cumpla o falla el test.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout esperando: %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// allSeatsReleased indica si todas las partidas que siguen registradas (las
+// terminadas se conservan hasta cleanupFinishedGames) tienen los asientos libres.
+func allSeatsReleased(h *Hub) bool {
+	h.mu.RLock()
+	games := make([]*Game, 0, len(h.games))
+	for _, g := range h.games {
+		games = append(games, g)
+	}
+	h.mu.RUnlock()
+
+	for _, g := range games {
+		released := true
+		ran := g.call(func() {
+			for _, c := range g.clients {
+				if c != nil {
+					released = false
+				}
+			}
+			if g.winnerIndex < 0 {
+				released = false
+			}
+		})
+		if ran && !released {
+			return false
+		}
+	}
+	return true
+}
+
+// seatOf devuelve el asiento del cliente según su partida, o -1.
+func seatOf(c *Client) int {
+	seat := invalidIndex
+	if g := c.game.Load(); g != nil {
+		g.call(func() { seat = g.seatOf(c) })
+	}
+	return seat
+}
+
+// startTestGame crea una partida con las opciones de create, sienta a un
+// cliente nuevo por cada IP de ips (el primero es el anfitrión), los marca a
+// todos como listos y empieza la partida con el orden de los asientos.
+// Devuelve la partida y los clientes por asiento.
+func startTestGame(t *testing.T, h *Hub, create InMessage, ips ...string) (*Game, []*Client) {
+	t.Helper()
+	host := newTestClient(h, ips[0])
+	create.Type = msgCreate
+	host.handleCreate(create)
+	g := host.game.Load()
+	if g == nil {
+		t.Fatalf("no se ha podido crear la partida")
+	}
+
+	players := []*Client{host}
+	for _, ip := range ips[1:] {
+		c := newTestClient(h, ip)
+		c.handleJoin(InMessage{Type: msgJoin, GameCode: g.code})
+		players = append(players, c)
+	}
+	for _, c := range players {
+		c.handleMessage(InMessage{Type: msgReady})
+	}
+	host.handleMessage(InMessage{Type: msgStart, TurnOrder: turnOrderFixed})
+
+	started := false
+	g.call(func() { started = g.gameStarted })
+	if !started {
+		t.Fatalf("la partida %s no ha empezado", g.code)
+	}
+	return g, players
+}
+
+func TestConcurrentJoinsFillEachSeatOnce(t *testing.T) {
+	h := startTestHub(t)
+	host := newTestClient(h, "10.0.0.1")
+	host.handleCreate(InMessage{Type: msgCreate, PlayerName: "host"})
+	code := host.game.Load().code
+
+	joiners := make([]*Client, 3*Cfg.NumPlayers)
+	var wg sync.WaitGroup
+	for i := range joiners {
+		c := newTestClient(h, "10.0.1."+strconv.Itoa(i))
+		joiners[i] = c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.handleJoin(InMessage{Type: msgJoin, GameCode: code, PlayerName: "p" + strconv.Itoa(i)})
+		}()
+	}
+	wg.Wait()
+
+	seats := make(map[int]*Client)
+	for _, c := range joiners {
+		seat := seatOf(c)
+		if seat < 0 {
+			continue
+		}
+		if other, taken := seats[seat]; taken {
+			t.Fatalf("asiento %d asignado a dos clientes (%p, %p)", seat, other, c)
+		}
+		seats[seat] = c
+	}
+	if len(seats) != Cfg.NumPlayers-1 {
+		t.Fatalf("se han sentado %d jugadores, se esperaban %d", len(seats), Cfg.NumPlayers-1)
+	}
+
+	g := host.game.Load()
+	g.call(func() {
+		for i, c := range g.clients {
+			if c == nil {
+				t.Errorf("asiento %d vacío con la partida llena", i)
+			} else if i > 0 && seats[i] != c {
+				t.Errorf("el asiento %d de la partida no coincide con el del cliente", i)
+			}
+		}
+	})
+}
+
+func TestConcurrentPlayAndDisconnects(t *testing.T) {
+	h := startTestHub(t)
+	const tables = 4
+	const actionsPerPlayer = 150
+
+	var wg sync.WaitGroup
+	for table := 0; table < tables; table++ {
+		ips := make([]string, Cfg.NumPlayers)
+		for i := range ips {
+			ips[i] = "10.1." + strconv.Itoa(table) + "." + strconv.Itoa(i+1)
+		}
+		_, players := startTestGame(t, h, InMessage{PlayerName: "host", VictoryScore: Cfg.MinVictoryScore}, ips...)
+		host := players[0]
+
+		for i, c := range players {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rng := rand.New(rand.NewSource(int64(table*100 + i)))
+				for n := 0; n < actionsPerPlayer; n++ {
+					switch rng.Intn(8) {
+					case 0, 1:
+						c.handleMessage(InMessage{Type: msgRoll})
+					case 2, 3:
+						c.handleMessage(InMessage{Type: msgToggleSelect, Index: rng.Intn(Cfg.NumDice)})
+					case 4:
+						c.handleMessage(InMessage{Type: msgSetAside})
+					case 5:
+						c.handleMessage(InMessage{Type: msgBank})
+					case 6:
+						c.handleMessage(InMessage{Type: msgGetState})
+					case 7:
+						c.handleMessage(InMessage{Type: msgUpdateConfig, VictoryScore: Cfg.MinVictoryScore})
+					}
+					// Algunos jugadores se desconectan a mitad de partida
+					if c != host && n == actionsPerPlayer/2 && rng.Intn(3) == 0 {
+						break
+					}
+				}
+				h.unregister <- c
+			}()
+		}
+	}
+	wg.Wait()
+
+	waitFor(t, "que se liberen todos los asientos", func() bool { return allSeatsReleased(h) })
+}
+
+func TestConcurrentCreateJoinAndDisconnect(t *testing.T) {
+	h := startTestHub(t)
+	const hosts = 20
+
+	codes := make(chan string, hosts)
+	var wg sync.WaitGroup
+	for i := 0; i < hosts; i++ {
+		host := newTestClient(h, "10.2.0."+strconv.Itoa(i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			host.handleCreate(InMessage{Type: msgCreate})
+			codes <- host.game.Load().code
+			host.handleMessage(InMessage{Type: msgStart})
+			host.handleMessage(InMessage{Type: msgRoll})
+			h.unregister <- host
+		}()
+	}
+	for i := 0; i < hosts*2; i++ {
+		c := newTestClient(h, "10.2.1."+strconv.Itoa(i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code := <-codes
+			codes <- code
+			c.handleJoin(InMessage{Type: msgJoin, GameCode: code})
+			c.handleMessage(InMessage{Type: msgRoll})
+			c.handleMessage(InMessage{Type: msgBank})
+			h.unregister <- c
+		}()
+	}
+	wg.Wait()
+
+	waitFor(t, "que se liberen todos los asientos", func() bool { return allSeatsReleased(h) })
+}
+
+func TestJoinLeavesPreviousGameAndResumeReseats(t *testing.T) {
+	h := startTestHub(t)
+	host := newTestClient(h, "10.3.0.1")
+	host.handleCreate(InMessage{Type: msgCreate, PlayerName: "host"})
+	g := host.game.Load()
+
+	other := newTestClient(h, "10.3.0.2")
+	other.handleCreate(InMessage{Type: msgCreate})
+	first := other.game.Load()
+
+	// Unirse a otra partida libera el asiento de la anterior
+	other.handleJoin(InMessage{Type: msgJoin, GameCode: g.code, PlayerName: "p1"})
+	other.handleJoin(InMessage{Type: msgJoin, GameCode: g.code, PlayerName: "p1"})
+	if seat := seatOf(other); seat != 1 {
+		t.Fatalf("asiento %d, se esperaba 1", seat)
+	}
+	if _, ok := h.game(first.code); ok {
+		t.Fatalf("la partida abandonada sigue registrada")
+	}
+	g.call(func() {
+		for i, c := range g.clients {
+			if c == other && i != 1 {
+				t.Errorf("el segundo join ha ocupado también el asiento %d", i)
+			}
+		}
+	})
+
+	host.handleMessage(InMessage{Type: msgReady})
+	other.handleMessage(InMessage{Type: msgReady})
+	host.handleMessage(InMessage{Type: msgStart})
+	late := newTestClient(h, "10.3.0.3")
+	late.handleJoin(InMessage{Type: msgJoin, GameCode: g.code})
+	if late.game.Load() != nil {
+		t.Fatalf("se ha admitido un join en una partida empezada")
+	}
+
+	var token string
+	g.call(func() { token = g.resumeTokens[1] })
+	h.unregister <- other
+	waitFor(t, "que se libere el asiento", func() bool {
+		free := false
+		g.call(func() { free = g.clients[1] == nil })
+		return free
+	})
+
+	late.handleJoin(InMessage{Type: msgJoin, GameCode: g.code, ResumeToken: token})
+	if seat := seatOf(late); seat != 1 {
+		t.Fatalf("asiento %d tras resumeToken, se esperaba 1", seat)
+	}
+	g.call(func() {
+		if g.playerNames[1] != "p1" || g.resumeTokens[1] == token {
+			t.Errorf("el asiento recuperado no conserva el nombre o no renueva el token")
+		}
+	})
+}
+
+func TestLeaveReleasesSeatAndKeepsConnection(t *testing.T) {
+	if Cfg.NumPlayers < 3 {
+		t.Skip("hacen falta al menos 3 asientos")
+	}
+	h := startTestHub(t)
+	g, players := startTestGame(t, h, InMessage{MaxPlayers: 3}, "10.4.0.1", "10.4.0.2", "10.4.0.3")
+	p1 := players[1]
+
+	p1.handleMessage(InMessage{Type: msgLeave})
+	if p1.game.Load() != nil {
+		t.Fatalf("el cliente sigue asociado a la partida tras leave")
+	}
+	g.call(func() {
+		if g.clients[1] != nil || g.resumeTokens[1] != "" {
+			t.Errorf("leave no ha liberado el asiento ni invalidado su token")
+		}
+		if g.winnerIndex >= 0 {
+			t.Errorf("la partida ha terminado aunque quedan dos jugadores")
+		}
+	})
+
+	p1.handleCreate(InMessage{Type: msgCreate})
+	if seatOf(p1) != 0 {
+		t.Fatalf("el cliente no puede crear otra partida tras leave")
+	}
+}
+
+func TestPublicLobbyListing(t *testing.T) {
+	h := startTestHub(t)
+	host := newTestClient(h, "10.5.0.1")
+	host.handleCreate(InMessage{Type: msgCreate, PlayerName: "host", Public: true})
+	private := newTestClient(h, "10.5.0.2")
+	private.handleCreate(InMessage{Type: msgCreate})
+
+	list := h.lobbies.list()
+	if len(list) != 1 || list[0].GameCode != host.game.Load().code || list[0].HostName != "host" || list[0].Players != 1 {
+		t.Fatalf("listado inesperado: %+v", list)
+	}
+
+	// Sin el mínimo de jugadores, o sin estar todos listos, no se puede empezar
+	host.handleMessage(InMessage{Type: msgReady})
+	host.handleMessage(InMessage{Type: msgStart})
+	guest := newTestClient(h, "10.5.0.3")
+	guest.handleJoin(InMessage{Type: msgJoin, GameCode: host.game.Load().code})
+	host.handleMessage(InMessage{Type: msgStart})
+	if list := h.lobbies.list(); len(list) != 1 || list[0].Players != 2 {
+		t.Fatalf("la partida ha empezado sin cumplir el mínimo o sin estar todos listos: %+v", list)
+	}
+
+	guest.handleMessage(InMessage{Type: msgReady})
+	host.handleMessage(InMessage{Type: msgStart})
+	if list := h.lobbies.list(); len(list) != 0 {
+		t.Fatalf("una partida empezada sigue en el listado: %+v", list)
+	}
+}
+
+func TestMatchmakingGroupsCompatiblePlayers(t *testing.T) {
+	h := startTestHub(t)
+	a := newTestClient(h, "10.6.0.1")
+	b := newTestClient(h, "10.6.0.2")
+	c := newTestClient(h, "10.6.0.3")
+
+	a.handleQueue(InMessage{Type: msgQueue, TableSize: 2, MinVictoryScore: 1000, MaxVictoryScore: 3000})
+	b.handleQueue(InMessage{Type: msgQueue, TableSize: 2, MinVictoryScore: 5000, MaxVictoryScore: 8000})
+	if a.game.Load() != nil || b.game.Load() != nil {
+		t.Fatalf("se han emparejado jugadores con rangos incompatibles")
+	}
+
+	c.handleQueue(InMessage{Type: msgQueue, TableSize: 2, MinVictoryScore: 2500, MaxVictoryScore: 6000})
+	g := a.game.Load()
+	if g == nil || c.game.Load() != g || b.game.Load() != nil {
+		t.Fatalf("no se ha emparejado a los jugadores compatibles")
+	}
+	g.call(func() {
+		if !g.gameStarted || g.victoryScore < 2500 || g.victoryScore > 3000 {
+			t.Errorf("partida sin empezar o con victoryScore %d fuera del rango común", g.victoryScore)
+		}
+	})
+
+	if !h.matchmaker.dequeue(b, queueLeft) {
+		t.Fatalf("el jugador sin pareja no seguía en cola")
+	}
+}
+
+func TestRoomPasswordAndLockout(t *testing.T) {
+	h := startTestHub(t)
+	secret := "secreto"
+	host := newTestClient(h, "10.7.0.1")
+	host.handleCreate(InMessage{Type: msgCreate, Password: &secret})
+	code := host.game.Load().code
+
+	wrong := "otra"
+	attacker := newTestClient(h, "10.7.0.2")
+	for i := 0; i < Cfg.JoinPasswordAttempts; i++ {
+		attacker.handleJoin(InMessage{Type: msgJoin, GameCode: code, Password: &wrong})
+	}
+	attacker.handleJoin(InMessage{Type: msgJoin, GameCode: code, Password: &secret})
+	if attacker.game.Load() != nil {
+		t.Fatalf("una IP bloqueada ha podido unirse")
+	}
+
+	friend := newTestClient(h, "10.7.0.3")
+	friend.handleJoin(InMessage{Type: msgJoin, GameCode: code})
+	if friend.game.Load() != nil {
+		t.Fatalf("se ha admitido un join sin contraseña")
+	}
+	friend.handleJoin(InMessage{Type: msgJoin, GameCode: code, Password: &secret})
+	if seatOf(friend) != 1 {
+		t.Fatalf("la contraseña correcta no permite unirse")
+	}
+}
+
+func TestJoinProbingIsThrottled(t *testing.T) {
+	h := startTestHub(t)
+	host := newTestClient(h, "10.8.0.1")
+	host.handleCreate(InMessage{Type: msgCreate})
+	code := host.game.Load().code
+
+	prober := newTestClient(h, "10.8.0.2")
+	for i := 0; i < Cfg.JoinMissRate.Burst; i++ {
+		prober.handleJoin(InMessage{Type: msgJoin, GameCode: "-" + strconv.Itoa(i)})
+	}
+	prober.handleJoin(InMessage{Type: msgJoin, GameCode: code})
+	if prober.game.Load() != nil {
+		t.Fatalf("una conexión que ha agotado los fallos de join ha podido unirse")
+	}
+}
+
+func TestHostKickAndBan(t *testing.T) {
+	h := startTestHub(t)
+	host := newTestClient(h, "10.9.0.1")
+	host.handleCreate(InMessage{Type: msgCreate})
+	g := host.game.Load()
+	kicked := newTestClient(h, "10.9.0.2")
+	banned := newTestClient(h, "10.9.0.3")
+	kicked.handleJoin(InMessage{Type: msgJoin, GameCode: g.code})
+	banned.handleJoin(InMessage{Type: msgJoin, GameCode: g.code})
+
+	kicked.handleMessage(InMessage{Type: msgKick, Index: 0})
+	if seatOf(host) != 0 {
+		t.Fatalf("un jugador que no es el anfitrión ha expulsado a alguien")
+	}
+
+	host.handleMessage(InMessage{Type: msgKick, Index: 1})
+	host.handleMessage(InMessage{Type: msgBan, Index: 2})
+	if kicked.game.Load() != nil || banned.game.Load() != nil {
+		t.Fatalf("los expulsados siguen asociados a la partida")
+	}
+
+	g.call(func() {
+		if g.winnerIndex >= 0 {
+			t.Errorf("expulsar en el lobby ha terminado la partida (ganador %d)", g.winnerIndex)
+		}
+	})
+
+	kicked.handleJoin(InMessage{Type: msgJoin, GameCode: g.code})
+	if seatOf(kicked) < 0 {
+		t.Fatalf("un jugador expulsado sin veto no puede volver")
+	}
+	banned.handleJoin(InMessage{Type: msgJoin, GameCode: g.code})
+	sameIP := newTestClient(h, "10.9.0.3")
+	sameIP.handleJoin(InMessage{Type: msgJoin, GameCode: g.code})
+	if banned.game.Load() != nil || sameIP.game.Load() != nil {
+		t.Fatalf("un jugador vetado ha vuelto a unirse")
+	}
+
+	// Con la partida empezada ya no se puede expulsar
+	host.handleMessage(InMessage{Type: msgReady})
+	kicked.handleMessage(InMessage{Type: msgReady})
+	host.handleMessage(InMessage{Type: msgStart})
+	host.handleMessage(InMessage{Type: msgKick, Index: seatOf(kicked)})
+	if kicked.game.Load() == nil {
+		t.Fatalf("se ha expulsado a un jugador con la partida empezada")
+	}
+}
+
+func TestReorderSeatsSetsFirstPlayer(t *testing.T) {
+	h := startTestHub(t)
+	host := newTestClient(h, "10.10.0.1")
+	host.handleCreate(InMessage{Type: msgCreate})
+	g := host.game.Load()
+	guest := newTestClient(h, "10.10.0.2")
+	guest.handleJoin(InMessage{Type: msgJoin, GameCode: g.code})
+
+	guest.handleMessage(InMessage{Type: msgReorderSeats, Values: []int{1, 0}})
+	host.handleMessage(InMessage{Type: msgReorderSeats, Values: []int{1, 1}})
+	host.handleMessage(InMessage{Type: msgReorderSeats, Values: []int{1}})
+
+	// Sin empezar la partida no se puede tirar
+	host.handleMessage(InMessage{Type: msgRoll})
+	g.call(func() {
+		if len(g.dice) != 0 {
+			t.Errorf("se ha tirado antes de empezar la partida: %v", g.dice)
+		}
+	})
+
+	host.handleMessage(InMessage{Type: msgReady})
+	guest.handleMessage(InMessage{Type: msgReady})
+	host.handleMessage(InMessage{Type: msgStart, TurnOrder: turnOrderFixed})
+
+	g.call(func() {
+		if !g.gameStarted || g.currentPlayerIndex != 1 {
+			t.Errorf("empieza el asiento %d, se esperaba el 1", g.currentPlayerIndex)
+		}
+		if next := g.nextActivePlayerIndex(1); next != 0 {
+			t.Errorf("después del asiento 1 va el %d, se esperaba el 0", next)
+		}
+	})
+
+	// Un segundo start no cambia el turno en curso
+	g.call(func() { g.currentPlayerIndex = 0 })
+	host.handleMessage(InMessage{Type: msgStart, TurnOrder: turnOrderFixed})
+	g.call(func() {
+		if g.currentPlayerIndex != 0 {
+			t.Errorf("un segundo start ha pasado el turno al asiento %d", g.currentPlayerIndex)
+		}
+	})
+}
+
+func TestPerGameMaxPlayers(t *testing.T) {
+	if Cfg.NumPlayers < 3 {
+		t.Skip("hacen falta al menos 3 asientos")
+	}
+	h := startTestHub(t)
+	host := newTestClient(h, "10.11.0.1")
+	for _, n := range []int{1, Cfg.NumPlayers + 1} {
+		host.handleCreate(InMessage{Type: msgCreate, MaxPlayers: n})
+		if host.game.Load() != nil {
+			t.Fatalf("se ha creado una partida con %d asientos", n)
+		}
+	}
+	host.handleCreate(InMessage{Type: msgCreate, MaxPlayers: 3})
+	g := host.game.Load()
+	a := newTestClient(h, "10.11.0.2")
+	b := newTestClient(h, "10.11.0.3")
+	a.handleJoin(InMessage{Type: msgJoin, GameCode: g.code})
+	b.handleJoin(InMessage{Type: msgJoin, GameCode: g.code})
+
+	host.handleMessage(InMessage{Type: msgUpdateConfig, MaxPlayers: 2})
+	g.call(func() {
+		if len(g.clients) != 3 {
+			t.Errorf("se ha reducido la mesa dejando fuera a un jugador sentado")
+		}
+	})
+
+	b.handleMessage(InMessage{Type: msgLeave})
+	host.handleMessage(InMessage{Type: msgUpdateConfig, MaxPlayers: 2})
+	b.handleJoin(InMessage{Type: msgJoin, GameCode: g.code})
+	if b.game.Load() != nil {
+		t.Fatalf("se ha admitido un jugador con la mesa llena")
+	}
+	g.call(func() {
+		if players := g.stateDocument()["players"].([]map[string]any); len(players) != 2 || len(g.turnOrder) != 2 {
+			t.Errorf("el estado no refleja la mesa de 2: %d jugadores, turnOrder %v", len(players), g.turnOrder)
+		}
+	})
+}
+
+func TestSpectatorWatchesButCannotPlay(t *testing.T) {
+	h := startTestHub(t)
+	host := newTestClient(h, "10.12.0.1")
+	host.handleCreate(InMessage{Type: msgCreate})
+	g := host.game.Load()
+
+	watcher := newTestClient(h, "10.12.0.2")
+	watcher.handleSpectate(InMessage{Type: msgSpectate, GameCode: g.code})
+	if watcher.game.Load() != g {
+		t.Fatalf("el espectador no está asociado a la partida")
+	}
+	watcher.handleMessage(InMessage{Type: msgReady})
+	g.call(func() {
+		if g.seatOf(watcher) >= 0 || g.ready[0] || len(g.spectators) != 1 {
+			t.Errorf("el espectador ocupa un asiento o ha podido actuar")
+		}
+		if n := g.stateDocument()["spectators"]; n != 1 {
+			t.Errorf("spectators = %v en el estado, se esperaba 1", n)
+		}
+	})
+
+	// Un espectador que se sienta deja de ser espectador
+	watcher.handleJoin(InMessage{Type: msgJoin, GameCode: g.code})
+	g.call(func() {
+		if g.seatOf(watcher) != 1 || g.spectators[watcher] {
+			t.Errorf("tras join: asiento %d, espectador %v", g.seatOf(watcher), g.spectators[watcher])
+		}
+	})
+
+	no := false
+	host.handleMessage(InMessage{Type: msgUpdateConfig, AllowSpectators: &no})
+	late := newTestClient(h, "10.12.0.3")
+	late.handleSpectate(InMessage{Type: msgSpectate, GameCode: g.code})
+	if late.game.Load() != nil {
+		t.Fatalf("se ha admitido un espectador con los espectadores desactivados")
+	}
+
+	h.unregister <- watcher
+	waitFor(t, "que se vaya el espectador", func() bool {
+		n := -1
+		g.call(func() { n = len(g.spectators) })
+		return n == 0
+	})
+}
+
+func TestChatFilterAndHistory(t *testing.T) {
+	f := newWordListFilter([]string{"caca"})
+	if got, _ := f.Filter("Qué CACA de tirada, caca!"); got != "Qué **** de tirada, ****!" {
+		t.Fatalf("filtro: %q", got)
+	}
+
+	h := startTestHub(t)
+	host := newTestClient(h, "10.13.0.1")
+	host.handleCreate(InMessage{Type: msgCreate, PlayerName: "host"})
+	g := host.game.Load()
+	watcher := newTestClient(h, "10.13.0.2")
+	watcher.handleSpectate(InMessage{Type: msgSpectate, GameCode: g.code})
+
+	host.handleMessage(InMessage{Type: msgChat, Text: "  hola  "})
+	watcher.handleMessage(InMessage{Type: msgChat, Text: "vamos"})
+	host.handleMessage(InMessage{Type: msgChat, Text: strings.Repeat("x", Cfg.ChatMaxLength+1)})
+	g.call(func() {
+		if len(g.chatHistory) != 2 {
+			t.Fatalf("historial con %d líneas, se esperaban 2", len(g.chatHistory))
+		}
+		if l := g.chatHistory[0]; l.Channel != chatChannelTable || l.Name != "host" || l.Text != "hola" {
+			t.Errorf("línea de la mesa inesperada: %+v", l)
+		}
+		if l := g.chatHistory[1]; l.Channel != chatChannelSpectators || l.PlayerIndex != invalidIndex {
+			t.Errorf("línea de espectador inesperada: %+v", l)
+		}
+	})
+}
+
+func TestMuteIsClearedWhenTheSeatIsFreed(t *testing.T) {
+	h := startTestHub(t)
+	host := newTestClient(h, "10.13.3.1")
+	host.handleCreate(InMessage{Type: msgCreate})
+	g := host.game.Load()
+	noisy := newTestClient(h, "10.13.3.2")
+	noisy.handleJoin(InMessage{Type: msgJoin, GameCode: g.code})
+
+	host.handleMessage(InMessage{Type: msgMute, Index: 1})
+	noisy.handleMessage(InMessage{Type: msgLeave})
+	next := newTestClient(h, "10.13.3.3")
+	next.handleJoin(InMessage{Type: msgJoin, GameCode: g.code})
+
+	muted := true
+	g.call(func() { muted = g.muted(host, 1) })
+	if seatOf(next) != 1 || muted {
+		t.Fatalf("el nuevo jugador del asiento 1 hereda el silencio (asiento %d)", seatOf(next))
+	}
+}
+
+func TestReactionsAreRecordedAndThrottled(t *testing.T) {
+	h := startTestHub(t)
+	host := newTestClient(h, "10.14.0.1")
+	host.handleCreate(InMessage{Type: msgCreate})
+	g := host.game.Load()
+
+	host.handleMessage(InMessage{Type: msgReact, Emote: "gg"})
+	host.handleMessage(InMessage{Type: msgReact, Emote: "no-existe"})
+	g.call(func() {
+		if len(g.events) != 1 || !strings.Contains(string(g.events[0].Event), `"emote":"gg"`) {
+			t.Errorf("registro de eventos inesperado: %d eventos", len(g.events))
+		}
+	})
+
+	limit := Cfg.MessageRateLimits[msgReact]
+	for i := 0; i < limit.Burst; i++ {
+		if ok, _ := host.allowMessage(msgReact); !ok {
+			t.Fatalf("reacción %d frenada dentro de la ráfaga", i)
+		}
+	}
+	if ok, _ := host.allowMessage(msgReact); ok {
+		t.Fatalf("no se frenan las reacciones tras agotar la ráfaga")
+	}
+}
+
+func TestTurnTimerBanksForfeitsAndFlags(t *testing.T) {
+	h := startTestHub(t)
+	rejected := newTestClient(h, "10.13.0.3")
+	invalid := -1
+	rejected.handleCreate(InMessage{Type: msgCreate, TurnSeconds: &invalid})
+	if rejected.game.Load() != nil {
+		t.Fatalf("se ha creado una partida con un tiempo por turno negativo")
+	}
+	turnSeconds := 1
+	g, _ := startTestGame(t, h, InMessage{TurnSeconds: &turnSeconds}, "10.13.0.1", "10.13.0.2")
+
+	// El anfitrión ha apartado dados: al vencer el turno se planta
+	g.call(func() {
+		g.turnPoints = 300
+		g.hasApartadoThisRoll = true
+	})
+	var total, current int
+	waitFor(t, "plantarse al vencer el turno", func() bool {
+		g.call(func() { total, current = g.totals[0], g.currentPlayerIndex })
+		return current == 1
+	})
+	if total != 300 {
+		t.Fatalf("total del anfitrión = %d, se esperaba 300", total)
+	}
+
+	// El invitado no ha apartado nada: pierde el turno
+	g.call(func() { g.turnPoints = 500 })
+	waitFor(t, "perder el turno al vencer", func() bool {
+		g.call(func() { total, current = g.totals[1], g.currentPlayerIndex })
+		return current == 0
+	})
+	if total != 0 {
+		t.Fatalf("total del invitado = %d, se esperaba 0", total)
+	}
+
+	// Con el reloj de ajedrez agotado el anfitrión pierde la partida
+	g.call(func() {
+		g.clockLimit = time.Minute
+		g.clocks[0], g.clocks[1] = 0, time.Minute
+		g.startTurnTimer()
+	})
+	var winner int
+	waitFor(t, "perder por tiempo", func() bool {
+		g.call(func() { winner = g.winnerIndex })
+		return winner >= 0
+	})
+	if winner != 1 {
+		t.Fatalf("ganador = %d, se esperaba el invitado", winner)
+	}
+}
+
+func TestFlaggedPlayersCannotWinWhenOthersLeave(t *testing.T) {
+	if Cfg.NumPlayers < 3 {
+		t.Skip("hacen falta al menos 3 asientos")
+	}
+	h := startTestHub(t)
+	clockSeconds := 60
+
+	// Con el anfitrión sin tiempo, si se va el asiento 1 solo queda el 2 en juego
+	g, players := startTestGame(t, h, InMessage{ClockSeconds: &clockSeconds, MaxPlayers: 3}, "10.13.1.1", "10.13.1.2", "10.13.1.3")
+	g.call(func() { g.flagPlayer(0) })
+	players[1].handleMessage(InMessage{Type: msgLeave})
+	winner := invalidIndex
+	g.call(func() { winner = g.winnerIndex })
+	if winner != 2 {
+		t.Fatalf("ganador = %d, se esperaba el asiento 2", winner)
+	}
+
+	// Si se va el anfitrión, no gana un jugador sin tiempo
+	g, players = startTestGame(t, h, InMessage{ClockSeconds: &clockSeconds, MaxPlayers: 3}, "10.13.2.1", "10.13.2.2", "10.13.2.3")
+	g.call(func() { g.flagPlayer(1) })
+	players[0].handleMessage(InMessage{Type: msgLeave})
+	g.call(func() { winner = g.winnerIndex })
+	if winner != 2 {
+		t.Fatalf("ganador = %d tras salir el anfitrión, se esperaba el asiento 2", winner)
+	}
+}
+
+func TestAFKPlayersAreSkippedAndRemoved(t *testing.T) {
+	defer func(old time.Duration) { Cfg.AfkRemoveAfter = old }(Cfg.AfkRemoveAfter)
+	Cfg.AfkRemoveAfter = 50 * time.Millisecond
+
+	h := startTestHub(t)
+	turnSeconds := 60
+	g, players := startTestGame(t, h, InMessage{TurnSeconds: &turnSeconds, MaxPlayers: 3}, "10.14.0.1", "10.14.0.2", "10.14.0.3")
+	guests := players[1:]
+
+	// Vencen el turno del anfitrión y el del asiento 1, que ya llevaba uno menos del umbral
+	g.call(func() {
+		g.timeouts[1] = Cfg.AfkTimeouts - 1
+		g.expireTurn()
+		g.expireTurn()
+		if !g.isAFK(1) || g.isAFK(0) {
+			t.Errorf("ausentes: asiento 0 %v, asiento 1 %v", g.isAFK(0), g.isAFK(1))
+		}
+		if next := g.nextActivePlayerIndex(0); next != 2 {
+			t.Errorf("después del asiento 0 va el %d, se esperaba el 2", next)
+		}
+	})
+
+	guests[0].handleMessage(InMessage{Type: msgBack})
+	g.call(func() {
+		if g.isAFK(1) {
+			t.Error("el asiento 1 sigue ausente tras back")
+		}
+		// Vuelve a ausentarse y no regresa
+		g.timeouts[1] = Cfg.AfkTimeouts - 1
+		g.currentPlayerIndex = 1
+		g.startTurnTimer()
+		g.expireTurn()
+	})
+	waitFor(t, "liberar el asiento del ausente", func() bool {
+		return guests[0].game.Load() == nil
+	})
+	g.call(func() {
+		if g.clients[1] != nil || g.winnerIndex >= 0 {
+			t.Errorf("asiento 1 = %v, ganador %d", g.clients[1], g.winnerIndex)
+		}
+	})
+}
+
+func TestAFKHostRemovalKeepsGameRunning(t *testing.T) {
+	defer func(old time.Duration) { Cfg.AfkRemoveAfter = old }(Cfg.AfkRemoveAfter)
+	Cfg.AfkRemoveAfter = 50 * time.Millisecond
+
+	h := startTestHub(t)
+	turnSeconds := 60
+	g, players := startTestGame(t, h, InMessage{TurnSeconds: &turnSeconds, MaxPlayers: 3}, "10.14.1.1", "10.14.1.2", "10.14.1.3")
+	host, guests := players[0], players[1:]
+
+	g.call(func() {
+		g.timeouts[0] = Cfg.AfkTimeouts - 1
+		g.expireTurn()
+	})
+	waitFor(t, "retirar al anfitrión ausente", func() bool {
+		return host.game.Load() == nil
+	})
+	var newHost, winner, current int
+	g.call(func() {
+		newHost, winner, current = g.host, g.winnerIndex, g.currentPlayerIndex
+	})
+	if newHost != 1 || winner >= 0 || current != 1 {
+		t.Fatalf("anfitrión %d, ganador %d, turno %d; se esperaba que la partida siguiera con el asiento 1 de anfitrión", newHost, winner, current)
+	}
+
+	// Al reiniciar se olvidan los turnos vencidos y las ausencias
+	g.call(func() {
+		g.timeouts[2] = Cfg.AfkTimeouts - 1
+		g.currentPlayerIndex = 2
+		g.startTurnTimer()
+		g.expireTurn()
+		g.winnerIndex = 1
+	})
+	guests[0].handleMessage(InMessage{Type: msgRestart})
+	g.call(func() {
+		if g.winnerIndex >= 0 || g.isAFK(2) || g.timeouts[2] != 0 {
+			t.Errorf("tras reiniciar: ganador %d, asiento 2 ausente %v con %d turnos vencidos", g.winnerIndex, g.isAFK(2), g.timeouts[2])
+		}
+	})
+}
+
+func TestStateAcksDoNotSpendActionTokens(t *testing.T) {
+	h := startTestHub(t)
+	c := newTestClient(h, "10.14.2.1")
+	for i := 0; i < Cfg.MessageRateLimits[rateLimitDefault].Burst*2; i++ {
+		if ok, _ := c.allowMessage(msgStateAck); !ok {
+			t.Fatalf("state_ack %d frenado", i)
+		}
+	}
+	if ok, _ := c.allowMessage(msgRoll); !ok {
+		t.Fatalf("los state_ack han agotado los tokens de roll")
+	}
+}
+
+func TestUndoSetAsideUntilNextRoll(t *testing.T) {
+	h := startTestHub(t)
+	g, players := startTestGame(t, h, InMessage{}, "10.15.0.1", "10.15.0.2")
+	host, guest := players[0], players[1]
+
+	g.call(func() {
+		g.dice = []Die{{Value: 1}, {Value: 5}, {Value: 2}, {Value: 2}, {Value: 3}, {Value: 4}}
+	})
+	host.handleMessage(InMessage{Type: msgToggleSelect, Index: 0})
+	host.handleMessage(InMessage{Type: msgSetAside})
+	host.handleMessage(InMessage{Type: msgToggleSelect, Index: 1})
+	host.handleMessage(InMessage{Type: msgSetAside})
+
+	guest.handleMessage(InMessage{Type: msgUndoSetAside})
+	host.handleMessage(InMessage{Type: msgUndoSetAside})
+	g.call(func() {
+		if g.turnPoints != 100 || len(g.turnMoves) != 1 || g.dice[1].Held || !g.dice[0].Held || !g.hasApartadoThisRoll {
+			t.Errorf("tras deshacer uno: puntos %d, movimientos %d, dados %v", g.turnPoints, len(g.turnMoves), g.dice)
+		}
+	})
+	host.handleMessage(InMessage{Type: msgUndoSetAside})
+	g.call(func() {
+		if g.turnPoints != 0 || len(g.turnMoves) != 0 || g.dice[0].Held || g.hasApartadoThisRoll {
+			t.Errorf("tras deshacer dos: puntos %d, movimientos %d, dados %v", g.turnPoints, len(g.turnMoves), g.dice)
+		}
+	})
+
+	// Después de tirar ya no se puede deshacer
+	host.handleMessage(InMessage{Type: msgSetAside})
+	host.handleMessage(InMessage{Type: msgRoll})
+	g.call(func() {
+		if len(g.undoStack) != 0 {
+			t.Errorf("quedan %d set_aside por deshacer tras tirar", len(g.undoStack))
+		}
+	})
+}
+
+func TestSetAsideWithIndicesIsAtomic(t *testing.T) {
+	h := startTestHub(t)
+	g, players := startTestGame(t, h, InMessage{}, "10.16.0.1", "10.16.0.2")
+	host := players[0]
+
+	g.call(func() {
+		g.dice = []Die{{Value: 1}, {Value: 5}, {Value: 2}, {Value: 2}, {Value: 3}, {Value: 4}}
+	})
+	// Selecciones no válidas: no se aparta ningún dado
+	host.handleMessage(InMessage{Type: msgSetAside, Values: []int{0, 2}})
+	host.handleMessage(InMessage{Type: msgSetAside, Values: []int{0, 0}})
+	host.handleMessage(InMessage{Type: msgSetAside, Values: []int{0, 9}})
+	g.call(func() {
+		for i, d := range g.dice {
+			if d.Held {
+				t.Errorf("dado %d apartado tras una selección no válida", i)
+			}
+		}
+		if g.turnPoints != 0 {
+			t.Errorf("puntos del turno = %d, se esperaba 0", g.turnPoints)
+		}
+	})
+
+	host.handleMessage(InMessage{Type: msgSetAsideAndBank, Values: []int{0, 1}})
+	g.call(func() {
+		if g.totals[0] != 150 || g.currentPlayerIndex != 1 {
+			t.Errorf("total %d y turno del asiento %d, se esperaba 150 y el asiento 1", g.totals[0], g.currentPlayerIndex)
+		}
+	})
+}
+
+func TestFailedJoinKeepsCurrentGame(t *testing.T) {
+	h := startTestHub(t)
+	host := newTestClient(h, "10.18.0.1")
+	host.handleCreate(InMessage{Type: msgCreate})
+	first := host.game.Load()
+	guest := newTestClient(h, "10.18.0.2")
+	guest.handleJoin(InMessage{Type: msgJoin, GameCode: first.code})
+
+	other := newTestClient(h, "10.18.0.3")
+	password := "clave"
+	other.handleCreate(InMessage{Type: msgCreate, Password: &password})
+	locked := other.game.Load()
+
+	wrong := "otra"
+	guest.handleJoin(InMessage{Type: msgJoin, GameCode: locked.code, Password: &wrong})
+	if guest.game.Load() != first || seatOf(guest) != 1 {
+		t.Fatalf("un join fallido ha sacado al jugador de su partida")
+	}
+	first.call(func() {
+		if first.winnerIndex >= 0 {
+			t.Errorf("un join fallido ha terminado la partida anterior")
+		}
+	})
+
+	guest.handleJoin(InMessage{Type: msgJoin, GameCode: locked.code, Password: &password})
+	if guest.game.Load() != locked || seatOf(guest) != 1 {
+		t.Fatalf("el join correcto no ha sentado al jugador")
+	}
+	first.call(func() {
+		if first.clients[1] != nil {
+			t.Errorf("el asiento de la partida anterior sigue ocupado")
+		}
+	})
+}
+
+func TestLeavingTheLobbyOnlyFreesTheSeat(t *testing.T) {
+	h := startTestHub(t)
+	host := newTestClient(h, "10.19.0.1")
+	host.handleCreate(InMessage{Type: msgCreate, MaxPlayers: 2})
+	g := host.game.Load()
+	guest := newTestClient(h, "10.19.0.2")
+	guest.handleJoin(InMessage{Type: msgJoin, GameCode: g.code})
+
+	guest.handleMessage(InMessage{Type: msgLeave})
+	g.call(func() {
+		if g.clients[1] != nil || g.winnerIndex >= 0 {
+			t.Errorf("tras salir el invitado: asiento 1 %v, ganador %d", g.clients[1], g.winnerIndex)
+		}
+	})
+
+	// Si sale el creador, el anfitrión pasa al otro jugador y la sala sigue abierta
+	guest.handleJoin(InMessage{Type: msgJoin, GameCode: g.code})
+	host.handleMessage(InMessage{Type: msgLeave})
+	g.call(func() {
+		if g.host != 1 || g.winnerIndex >= 0 {
+			t.Errorf("tras salir el creador: anfitrión %d, ganador %d", g.host, g.winnerIndex)
+		}
+	})
+	late := newTestClient(h, "10.19.0.3")
+	late.handleJoin(InMessage{Type: msgJoin, GameCode: g.code})
+	late.handleMessage(InMessage{Type: msgReady})
+	guest.handleMessage(InMessage{Type: msgReady})
+	guest.handleMessage(InMessage{Type: msgStart})
+	g.call(func() {
+		if !g.gameStarted {
+			t.Error("el nuevo anfitrión no ha podido empezar la partida")
+		}
+	})
+}
+
+func TestSpectateRequiresPasswordAndCountsProbes(t *testing.T) {
+	h := startTestHub(t)
+	host := newTestClient(h, "10.20.0.1")
+	password := "clave"
+	host.handleCreate(InMessage{Type: msgCreate, Password: &password})
+	code := host.game.Load().code
+
+	watcher := newTestClient(h, "10.20.0.2")
+	watcher.handleSpectate(InMessage{Type: msgSpectate, GameCode: code})
+	if watcher.game.Load() != nil {
+		t.Fatalf("se puede ver una sala con contraseña sin darla")
+	}
+	watcher.handleSpectate(InMessage{Type: msgSpectate, GameCode: code, Password: &password})
+	if watcher.game.Load() == nil {
+		t.Fatalf("no se puede ver la sala con la contraseña correcta")
+	}
+
+	prober := newTestClient(h, "10.20.0.3")
+	for i := 0; i < Cfg.JoinMissRate.Burst; i++ {
+		prober.handleSpectate(InMessage{Type: msgSpectate, GameCode: "-" + strconv.Itoa(i)})
+	}
+	prober.handleSpectate(InMessage{Type: msgSpectate, GameCode: code, Password: &password})
+	if prober.game.Load() != nil {
+		t.Fatalf("una conexión que ha agotado los fallos de spectate ha podido entrar")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// lobbySummary describe una partida pública abierta en el listado de lobbies.
+type lobbySummary struct {
+	GameCode                string    `json:"gameCode"`
+	HostName                string    `json:"hostName"`
+	Players                 int       `json:"players"`
+	MaxPlayers              int       `json:"maxPlayers"`
+	VictoryScore            int       `json:"victoryScore"`
+	BonusAfterSecondHotDice bool      `json:"bonusAfterSecondHotDice"`
+	HasPassword             bool      `json:"hasPassword"`
+	createdAt               time.Time // para ordenar el listado
+}
+
+// lobbyBoard guarda el listado de partidas públicas abiertas y los clientes
+// suscritos a sus cambios. Lo actualiza cada partida desde su event loop.
+type lobbyBoard struct {
+	mu          sync.Mutex
+	lobbies     map[string]lobbySummary
+	subscribers map[*Client]bool
+}
+
+// list devuelve las partidas abiertas, de la más antigua a la más reciente.
+func (b *lobbyBoard) list() []lobbySummary {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.listLocked()
+}
+
+func (b *lobbyBoard) listLocked() []lobbySummary {
+	list := make([]lobbySummary, 0, len(b.lobbies))
+	for _, s := range b.lobbies {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].createdAt.Equal(list[j].createdAt) {
+			return list[i].createdAt.Before(list[j].createdAt)
+		}
+		return list[i].GameCode < list[j].GameCode
+	})
+	return list
+}
+
+// update publica el resumen de una partida y avisa a los suscritos si ha cambiado.
+func (b *lobbyBoard) update(s lobbySummary) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.lobbies == nil {
+		b.lobbies = make(map[string]lobbySummary)
+	}
+	if old, ok := b.lobbies[s.GameCode]; ok && old == s {
+		return
+	}
+	b.lobbies[s.GameCode] = s
+	b.notifyLocked(map[string]any{jsonKeyType: msgLobbyUpdated, "game": s})
+}
+
+// remove quita una partida del listado y avisa a los suscritos.
+func (b *lobbyBoard) remove(code string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.lobbies[code]; !ok {
+		return
+	}
+	delete(b.lobbies, code)
+	b.notifyLocked(map[string]any{jsonKeyType: msgLobbyRemoved, jsonKeyGameCode: code})
+}
+
+func (b *lobbyBoard) notifyLocked(payload any) {
+	if len(b.subscribers) == 0 {
+		return
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	for c := range b.subscribers {
+		c.sendRaw(data)
+	}
+}
+
+// subscribe apunta al cliente a los cambios del listado y le envía el listado
+// actual, de modo que no se pierde ningún cambio entre ambos.
+func (b *lobbyBoard) subscribe(c *Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[*Client]bool)
+	}
+	b.subscribers[c] = true
+	c.sendGamesList(b.listLocked())
+}
+
+func (b *lobbyBoard) unsubscribe(c *Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, c)
+}
+
+func (c *Client) sendGamesList(list []lobbySummary) {
+	c.sendJSON(map[string]any{jsonKeyType: msgGamesList, "games": list})
+}
+
+// publishLobby actualiza la entrada de la partida en el listado de lobbies:
+// aparece mientras sea pública, no haya empezado y tenga asientos libres.
+func (g *Game) publishLobby() {
+	players := 0
+	for _, c := range g.clients {
+		if c != nil {
+			players++
+		}
+	}
+	open := g.public && !g.closed && !g.gameStarted && g.winnerIndex < 0 && players > 0 && players < len(g.clients)
+	if !open {
+		g.hub.lobbies.remove(g.code)
+		return
+	}
+	g.hub.lobbies.update(lobbySummary{
+		GameCode:                g.code,
+		HostName:                g.playerNames[g.host],
+		Players:                 players,
+		MaxPlayers:              len(g.clients),
+		VictoryScore:            g.victoryScore,
+		BonusAfterSecondHotDice: g.bonusAfterSecondHotDice,
+		HasPassword:             g.passwordHash != nil,
+		createdAt:               g.createdAt,
+	})
+}
+
+// handleListGames sirve GET /games con el listado de partidas públicas
+// abiertas. Aplica la misma admisión que /ws: token de acceso y límite por IP.
+func handleListGames(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !validJoinToken(r.URL.Query().Get("token")) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if ok, wait := hub.listLimiter.allow(clientIP(r), Cfg.ListGamesRatePerIP, time.Now()); !ok {
+		rateLimitedTotal.WithLabelValues(rateLimitListGames).Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && originAllowed(origin, r.Host) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Vary", "Origin")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hub.lobbies.list())
+}
@@ -1,21 +1,36 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Permite conexiones desde cualquier origen (solo para desarrollo)
-	},
+	CheckOrigin: checkOrigin,
 }
 
 func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if !validJoinToken(r.URL.Query().Get("token")) {
+		wsRejectedTotal.WithLabelValues(rejectToken).Inc()
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	ip := clientIP(r)
+	if !hub.conns.acquire(ip) {
+		wsRejectedTotal.WithLabelValues(rejectIPLimit).Inc()
+		log.Println("Conexión rechazada, demasiadas conexiones desde", ip)
+		http.Error(w, "Too many connections", http.StatusTooManyRequests)
+		return
+	}
+	defer hub.conns.release(ip)
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("Error al hacer upgrade:", err)
@@ -23,9 +38,11 @@ func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	}
 
 	client := &Client{
-		hub:  hub,
-		conn: conn,
-		send: make(chan []byte, Cfg.SendBufferSize),
+		hub:        hub,
+		conn:       conn,
+		ip:         ip,
+		send:       make(chan []byte, Cfg.SendBufferSize),
+		stateReady: make(chan struct{}, 1),
 	}
 	client.hub.register <- client
 
@@ -34,6 +51,20 @@ func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	signToken := flag.Duration("sign-join-token", 0, "imprime un token de acceso válido durante la duración indicada y termina")
+	flag.Parse()
+	if *signToken > 0 {
+		if Cfg.JoinSecret == "" {
+			log.Fatal("FARKLE_JOIN_SECRET no está configurado")
+		}
+		fmt.Println(signJoinToken(Cfg.JoinSecret, time.Now().Add(*signToken)))
+		return
+	}
+
+	if len(Cfg.AllowedOrigins) == 0 {
+		log.Println("FARKLE_ALLOWED_ORIGINS vacío: solo se aceptan conexiones desde el mismo origen")
+	}
+
 	hub := newHub()
 	go hub.run()
 	go hub.cleanupFinishedGames()
@@ -43,6 +74,9 @@ func main() {
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		handleWebSocket(hub, w, r)
 	})
+	http.HandleFunc("/games", func(w http.ResponseWriter, r *http.Request) {
+		handleListGames(hub, w, r)
+	})
 	log.Println("Servidor WebSocket escuchando en", fmt.Sprintf("ws://localhost%s/ws", addr))
 	log.Fatal(http.ListenAndServe(addr, nil))
 }
@@ -0,0 +1,271 @@
+package main
+
+import "time"
+
+// matchmakingInterval es cada cuánto revisa el matchmaker los tiempos de espera.
+const matchmakingInterval = time.Second
+
+// Motivos de salida de la cola (etiqueta outcome de matchmakingWaitSeconds)
+const (
+	queueMatched      = "matched"
+	queueLeft         = "left"
+	queueTimeout      = "timeout"
+	queueDisconnected = "disconnected"
+)
+
+// queueEntry es un jugador esperando partida rápida.
+type queueEntry struct {
+	client          *Client
+	name            string
+	tableSize       int
+	minVictoryScore int
+	maxVictoryScore int
+	queuedAt        time.Time
+	position        int // última posición notificada con queue_status
+	waiting         int // último número de jugadores en espera notificado
+}
+
+// compatible indica si el jugador acepta la mesa y el rango [lo, hi].
+func (e *queueEntry) compatible(tableSize, lo, hi int) bool {
+	return e.tableSize == tableSize && e.minVictoryScore <= hi && e.maxVictoryScore >= lo
+}
+
+// matchmaker agrupa a los jugadores en cola con opciones compatibles y les
+// crea una partida. Igual que las partidas, tiene su propio event loop y la
+// cola solo se toca desde sus comandos.
+type matchmaker struct {
+	hub      *Hub
+	commands chan func()
+	queue    []*queueEntry
+}
+
+func newMatchmaker(hub *Hub) *matchmaker {
+	return &matchmaker{hub: hub, commands: make(chan func())}
+}
+
+func (m *matchmaker) run() {
+	ticker := time.NewTicker(matchmakingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case cmd := <-m.commands:
+			cmd()
+		case now := <-ticker.C:
+			m.expire(now)
+		}
+	}
+}
+
+// call ejecuta cmd en el event loop del matchmaker y espera a que termine.
+func (m *matchmaker) call(cmd func()) {
+	done := make(chan struct{})
+	m.commands <- func() {
+		defer close(done)
+		cmd()
+	}
+	<-done
+}
+
+// enqueue pone al cliente en la cola, o actualiza sus opciones conservando su
+// posición si ya estaba, e intenta formar partidas.
+func (m *matchmaker) enqueue(e *queueEntry) {
+	m.call(func() {
+		if i := m.indexOf(e.client); i >= 0 {
+			old := m.queue[i]
+			e.queuedAt = old.queuedAt
+			m.queue[i] = e
+		} else {
+			m.queue = append(m.queue, e)
+		}
+		m.match()
+		m.notifyPositions()
+	})
+}
+
+// dequeue saca al cliente de la cola. Devuelve false si no estaba en ella.
+func (m *matchmaker) dequeue(c *Client, outcome string) bool {
+	removed := false
+	m.call(func() {
+		i := m.indexOf(c)
+		if i < 0 {
+			return
+		}
+		removed = true
+		m.remove(i, outcome, time.Now())
+		if outcome == queueLeft {
+			c.sendJSON(map[string]any{jsonKeyType: msgQueueLeft})
+		}
+		m.notifyPositions()
+	})
+	return removed
+}
+
+func (m *matchmaker) indexOf(c *Client) int {
+	for i, e := range m.queue {
+		if e.client == c {
+			return i
+		}
+	}
+	return invalidIndex
+}
+
+func (m *matchmaker) remove(i int, outcome string, now time.Time) {
+	matchmakingWaitSeconds.WithLabelValues(outcome).Observe(now.Sub(m.queue[i].queuedAt).Seconds())
+	m.queue = append(m.queue[:i], m.queue[i+1:]...)
+	matchmakingQueueSize.Set(float64(len(m.queue)))
+}
+
+// expire saca de la cola a los que llevan esperando más de Cfg.QueueTimeout.
+func (m *matchmaker) expire(now time.Time) {
+	expired := false
+	for i := 0; i < len(m.queue); {
+		e := m.queue[i]
+		if now.Sub(e.queuedAt) < Cfg.QueueTimeout {
+			i++
+			continue
+		}
+		m.remove(i, queueTimeout, now)
+		e.client.sendJSON(map[string]any{
+			jsonKeyType: msgQueueTimeout,
+			jsonKeyMsg:  "No se ha encontrado partida",
+		})
+		expired = true
+	}
+	if expired {
+		m.notifyPositions()
+	}
+}
+
+// match forma todas las partidas posibles. Se recorre la cola por orden de
+// llegada: cada jugador se agrupa con los siguientes que quieren la misma mesa
+// y cuyo rango de puntuación de victoria se solapa con el del grupo.
+func (m *matchmaker) match() {
+	for i := 0; i < len(m.queue); i++ {
+		anchor := m.queue[i]
+		group := []*queueEntry{anchor}
+		lo, hi := anchor.minVictoryScore, anchor.maxVictoryScore
+		for _, e := range m.queue[i+1:] {
+			if len(group) == anchor.tableSize {
+				break
+			}
+			if e.compatible(anchor.tableSize, lo, hi) {
+				group = append(group, e)
+				lo, hi = max(lo, e.minVictoryScore), min(hi, e.maxVictoryScore)
+			}
+		}
+		if len(group) < anchor.tableSize {
+			continue
+		}
+
+		now := time.Now()
+		for _, e := range group {
+			m.remove(m.indexOf(e.client), queueMatched, now)
+		}
+		m.startMatch(group, min(max(Cfg.DefaultVictoryScore, lo), hi))
+		i = -1
+	}
+}
+
+// startMatch crea la partida, sienta al grupo y la empieza. Se ejecuta en la
+// goroutine del matchmaker, no en la readPump de los jugadores, así que los
+// errores se les envían con sendAsyncError.
+func (m *matchmaker) startMatch(group []*queueEntry, victoryScore int) {
+	host := group[0].client
+	g := host.createGame(InMessage{
+		Type:         msgCreate,
+		PlayerName:   group[0].name,
+		VictoryScore: victoryScore,
+		MaxPlayers:   len(group),
+	})
+	if g == nil {
+		for _, e := range group {
+			e.client.sendAsyncError(errNoGameCode)
+		}
+		return
+	}
+	for _, e := range group[1:] {
+		joined := false
+		g.call(func() { joined = g.seatPlayer(e.client, e.name) })
+		if !joined {
+			e.client.sendAsyncError(errGameFull)
+			continue
+		}
+		e.client.game.Store(g)
+	}
+	g.call(func() {
+		// En partida rápida no hay lobby: todos están listos desde el principio
+		seated := 0
+		for i, other := range g.clients {
+			g.ready[i] = other != nil
+			if other != nil {
+				seated++
+			}
+		}
+		if seated < g.minPlayers {
+			host.sendAsyncError(errNotEnoughPlayers)
+			return
+		}
+		g.applyTurnOrder(turnOrderShuffle)
+		g.startGame()
+	})
+}
+
+// notifyPositions envía queue_status a los jugadores cuya posición (entre los
+// que esperan la misma mesa) o número de jugadores en espera ha cambiado.
+func (m *matchmaker) notifyPositions() {
+	waiting := make(map[int]int)
+	for _, e := range m.queue {
+		waiting[e.tableSize]++
+	}
+	seen := make(map[int]int)
+	for _, e := range m.queue {
+		seen[e.tableSize]++
+		position := seen[e.tableSize]
+		if position == e.position && waiting[e.tableSize] == e.waiting {
+			continue
+		}
+		e.position, e.waiting = position, waiting[e.tableSize]
+		e.client.sendJSON(map[string]any{
+			jsonKeyType: msgQueueStatus,
+			"position":  e.position,
+			"waiting":   e.waiting,
+			"tableSize": e.tableSize,
+		})
+	}
+}
+
+// handleQueue pone al cliente en la cola de partida rápida. Sale antes de la
+// partida en la que esté.
+func (c *Client) handleQueue(msg InMessage) {
+	tableSize := msg.TableSize
+	if tableSize == 0 {
+		tableSize = 2
+	}
+	lo, hi := msg.MinVictoryScore, msg.MaxVictoryScore
+	if lo == 0 {
+		lo = Cfg.MinVictoryScore
+	}
+	if hi == 0 {
+		hi = Cfg.MaxVictoryScore
+	}
+	if tableSize < 2 || tableSize > Cfg.NumPlayers || lo < Cfg.MinVictoryScore || hi > Cfg.MaxVictoryScore || lo > hi {
+		c.sendError(errInvalidQueue)
+		return
+	}
+
+	c.leaveGame()
+	c.hub.matchmaker.enqueue(&queueEntry{
+		client:          c,
+		name:            msg.PlayerName,
+		tableSize:       tableSize,
+		minVictoryScore: lo,
+		maxVictoryScore: hi,
+		queuedAt:        time.Now(),
+	})
+}
+
+func (c *Client) handleLeaveQueue() {
+	if !c.hub.matchmaker.dequeue(c, queueLeft) {
+		c.sendError(errNotQueued)
+	}
+}
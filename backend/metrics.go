@@ -2,6 +2,13 @@ package main
 
 import "github.com/prometheus/client_golang/prometheus"
 
+// Valores de la etiqueta action de outboundBackpressureTotal
+const (
+	backpressureDropped      = "dropped"
+	backpressureCoalesced    = "coalesced"
+	backpressureDisconnected = "disconnected"
+)
+
 var (
 	gamesCreatedTotal = prometheus.NewCounter(
 		prometheus.CounterOpts{
@@ -38,6 +45,54 @@ var (
 		},
 	)
 
+	outboundBackpressureTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "farkle_ws_outbound_backpressure_total",
+			Help: "Outbound messages dropped or coalesced, and clients disconnected, because a send queue was full",
+		},
+		[]string{"action"},
+	)
+
+	wsRejectedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "farkle_ws_rejected_connections_total",
+			Help: "WebSocket connections rejected by the admission policy",
+		},
+		[]string{"reason"},
+	)
+
+	rateLimitedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "farkle_rate_limited_messages_total",
+			Help: "Inbound messages rejected by rate limiting, by limit",
+		},
+		[]string{"limit"},
+	)
+
+	matchmakingQueueSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "farkle_matchmaking_queue_size",
+			Help: "Number of players waiting in the matchmaking queue",
+		},
+	)
+
+	matchmakingWaitSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "farkle_matchmaking_wait_seconds",
+			Help:    "Time spent in the matchmaking queue, by outcome",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		},
+		[]string{"outcome"},
+	)
+
+	turnTimeoutsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "farkle_turn_timeouts_total",
+			Help: "Turns ended because the player ran out of time, by outcome",
+		},
+		[]string{"outcome"},
+	)
+
 	rollDuration = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
 			Name:    "farkle_roll_duration_seconds",
@@ -55,6 +110,12 @@ func init() {
 		wsConnections,
 		farklesTotal,
 		rollDuration,
+		outboundBackpressureTotal,
+		wsRejectedTotal,
+		rateLimitedTotal,
+		matchmakingQueueSize,
+		matchmakingWaitSeconds,
+		turnTimeoutsTotal,
 	)
 }
 
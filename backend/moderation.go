@@ -0,0 +1,51 @@
+package main
+
+// handleKick permite al anfitrión expulsar en el lobby al jugador del asiento
+// msg.Index; una vez empezada la partida no se puede expulsar a nadie. El
+// asiento queda libre y el token para recuperarlo deja de valer. Con ban,
+// además, ni esa conexión ni su IP pueden volver a unirse a la partida.
+func (g *Game) handleKick(c *Client, msg InMessage, ban bool) {
+	seat := g.seatOf(c)
+	if seat < 0 {
+		g.sendNotSeated(c)
+		return
+	}
+	if seat != g.host {
+		c.sendError("Only the creator can remove players")
+		return
+	}
+	if g.gameStarted {
+		c.sendError(errGameAlreadyStarted)
+		return
+	}
+	if msg.Index < 0 || msg.Index == g.host || msg.Index >= len(g.clients) || g.clients[msg.Index] == nil {
+		c.sendError(errInvalidIndex)
+		return
+	}
+
+	target := g.clients[msg.Index]
+	if ban {
+		if g.bannedClients == nil {
+			g.bannedClients = make(map[*Client]bool)
+			g.bannedIPs = make(map[string]bool)
+		}
+		g.bannedClients[target] = true
+		g.bannedIPs[target.ip] = true
+	}
+
+	// El expulsado sigue conectado, pero sin partida
+	target.game.CompareAndSwap(g, nil)
+	target.sendJSON(map[string]any{
+		jsonKeyType:     msgKicked,
+		jsonKeyGameCode: g.code,
+		"banned":        ban,
+	})
+
+	g.resumeTokens[msg.Index] = ""
+	g.removePlayer(msg.Index, msgPlayerKicked)
+}
+
+// isBanned indica si el anfitrión ha vetado la conexión o su IP.
+func (g *Game) isBanned(c *Client) bool {
+	return g.bannedClients[c] || g.bannedIPs[c.ip]
+}
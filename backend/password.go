@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"sync"
+	"time"
+)
+
+// hashRoomPassword devuelve el hash con el que se guarda la contraseña de una
+// sala. Al tener longitud fija permite compararlas en tiempo constante.
+func hashRoomPassword(password string) []byte {
+	sum := sha256.Sum256([]byte(password))
+	return sum[:]
+}
+
+// checkPassword compara password con la contraseña de la partida en tiempo constante.
+func (g *Game) checkPassword(password string) bool {
+	return subtle.ConstantTimeCompare(hashRoomPassword(password), g.passwordHash) == 1
+}
+
+// setPassword cambia la contraseña de la partida ("" la quita).
+func (g *Game) setPassword(password string) {
+	if password == "" {
+		g.passwordHash = nil
+		return
+	}
+	g.passwordHash = hashRoomPassword(password)
+}
+
+type passwordFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// passwordLockout cuenta las contraseñas de sala erróneas por IP y bloquea la
+// IP durante Cfg.JoinPasswordLockout tras Cfg.JoinPasswordAttempts fallos
+// seguidos (los fallos se olvidan tras ese mismo tiempo sin fallar).
+type passwordLockout struct {
+	mu       sync.Mutex
+	failures map[string]*passwordFailures
+}
+
+// locked indica si la IP está bloqueada y cuánto le queda.
+func (l *passwordLockout) locked(ip string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.failures[ip]
+	if !ok || !now.Before(f.lockedUntil) {
+		return false, 0
+	}
+	return true, f.lockedUntil.Sub(now)
+}
+
+// fail registra un fallo. Devuelve true si la IP queda bloqueada.
+func (l *passwordLockout) fail(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failures == nil {
+		l.failures = make(map[string]*passwordFailures)
+	}
+	f, ok := l.failures[ip]
+	if !ok || now.Sub(f.last) > Cfg.JoinPasswordLockout {
+		f = &passwordFailures{}
+		l.failures[ip] = f
+	}
+	f.count++
+	f.last = now
+	if Cfg.JoinPasswordAttempts > 0 && f.count >= Cfg.JoinPasswordAttempts {
+		f.count = 0
+		f.lockedUntil = now.Add(Cfg.JoinPasswordLockout)
+		return true
+	}
+	return false
+}
+
+// reset olvida los fallos de la IP tras una contraseña correcta.
+func (l *passwordLockout) reset(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, ip)
+}
+
+// prune elimina las IPs sin bloqueo ni fallos recientes.
+func (l *passwordLockout) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, f := range l.failures {
+		if !now.Before(f.lockedUntil) && now.Sub(f.last) > Cfg.JoinPasswordLockout {
+			delete(l.failures, ip)
+		}
+	}
+}
+
+// checkJoinPassword comprueba la contraseña de un join aplicando el bloqueo
+// por IP. Si no es válida, responde al cliente con el error y devuelve false.
+func (g *Game) checkJoinPassword(c *Client, password string) bool {
+	if g.passwordHash == nil {
+		return true
+	}
+	now := time.Now()
+	lockout := &g.hub.passwordLockout
+	if locked, _ := lockout.locked(c.ip, now); locked {
+		c.sendError(errPasswordLocked)
+		return false
+	}
+	if !g.checkPassword(password) {
+		if lockout.fail(c.ip, now) {
+			c.sendError(errPasswordLocked)
+		} else {
+			c.sendError(errWrongPassword)
+		}
+		return false
+	}
+	lockout.reset(c.ip)
+	return true
+}
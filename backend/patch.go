@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Operaciones JSON Patch (RFC 6902) que genera diffJSON.
+const (
+	patchOpAdd     = "add"
+	patchOpRemove  = "remove"
+	patchOpReplace = "replace"
+)
+
+// patchOp es una operación JSON Patch. Solo se generan add, remove y replace.
+type patchOp struct {
+	Op    string
+	Path  string
+	Value any
+}
+
+func (p patchOp) MarshalJSON() ([]byte, error) {
+	if p.Op == patchOpRemove {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{p.Op, p.Path})
+	}
+	return json.Marshal(struct {
+		Op    string `json:"op"`
+		Path  string `json:"path"`
+		Value any    `json:"value"`
+	}{p.Op, p.Path, p.Value})
+}
+
+// normalizeJSON convierte v a su forma JSON genérica (map[string]any, []any,
+// float64, string, bool, nil) para poder compararla y calcular diferencias.
+func normalizeJSON(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out any
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// diffJSON devuelve las operaciones que transforman from en to. Ambos valores
+// deben estar normalizados con normalizeJSON.
+func diffJSON(from, to any) []patchOp {
+	return appendDiff(nil, "", from, to)
+}
+
+func appendDiff(ops []patchOp, path string, from, to any) []patchOp {
+	switch a := from.(type) {
+	case map[string]any:
+		b, ok := to.(map[string]any)
+		if !ok {
+			break
+		}
+		removed := make([]string, 0)
+		for k := range a {
+			if _, ok := b[k]; !ok {
+				removed = append(removed, k)
+			}
+		}
+		sort.Strings(removed)
+		for _, k := range removed {
+			ops = append(ops, patchOp{Op: patchOpRemove, Path: path + "/" + escapePointer(k)})
+		}
+		keys := make([]string, 0, len(b))
+		for k := range b {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := path + "/" + escapePointer(k)
+			if old, ok := a[k]; ok {
+				ops = appendDiff(ops, p, old, b[k])
+			} else {
+				ops = append(ops, patchOp{Op: patchOpAdd, Path: p, Value: b[k]})
+			}
+		}
+		return ops
+	case []any:
+		b, ok := to.([]any)
+		if !ok {
+			break
+		}
+		common := min(len(a), len(b))
+		for i := 0; i < common; i++ {
+			ops = appendDiff(ops, path+"/"+strconv.Itoa(i), a[i], b[i])
+		}
+		for i := common; i < len(b); i++ {
+			ops = append(ops, patchOp{Op: patchOpAdd, Path: path + "/" + strconv.Itoa(i), Value: b[i]})
+		}
+		// Se eliminan desde el final para que los índices sigan siendo válidos
+		for i := len(a) - 1; i >= common; i-- {
+			ops = append(ops, patchOp{Op: patchOpRemove, Path: path + "/" + strconv.Itoa(i)})
+		}
+		return ops
+	}
+
+	if !reflect.DeepEqual(from, to) {
+		ops = append(ops, patchOp{Op: patchOpReplace, Path: path, Value: to})
+	}
+	return ops
+}
+
+// escapePointer escapa un token de JSON Pointer (RFC 6901).
+func escapePointer(token string) string {
+	token = strings.ReplaceAll(token, "~", "~0")
+	return strings.ReplaceAll(token, "/", "~1")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// applyPatch aplica ops a doc siguiendo RFC 6902 (solo add, remove y replace)
+// y devuelve el documento resultante.
+func applyPatch(t *testing.T, doc any, ops []patchOp) any {
+	t.Helper()
+	for _, op := range ops {
+		if op.Path == "" {
+			if op.Op != patchOpReplace {
+				t.Fatalf("operación %q sobre la raíz", op.Op)
+			}
+			doc = op.Value
+			continue
+		}
+		tokens := strings.Split(op.Path[1:], "/")
+		for i, tok := range tokens {
+			tokens[i] = strings.ReplaceAll(strings.ReplaceAll(tok, "~1", "/"), "~0", "~")
+		}
+		doc = applyOp(t, doc, tokens, op)
+	}
+	return doc
+}
+
+func applyOp(t *testing.T, node any, tokens []string, op patchOp) any {
+	t.Helper()
+	tok, last := tokens[0], len(tokens) == 1
+	switch n := node.(type) {
+	case map[string]any:
+		if !last {
+			n[tok] = applyOp(t, n[tok], tokens[1:], op)
+			return n
+		}
+		_, exists := n[tok]
+		switch op.Op {
+		case patchOpAdd:
+			n[tok] = op.Value
+		case patchOpReplace:
+			if !exists {
+				t.Fatalf("replace de %s, que no existe", op.Path)
+			}
+			n[tok] = op.Value
+		case patchOpRemove:
+			if !exists {
+				t.Fatalf("remove de %s, que no existe", op.Path)
+			}
+			delete(n, tok)
+		}
+		return n
+	case []any:
+		i, err := strconv.Atoi(tok)
+		if err != nil || i < 0 || i > len(n) || (i == len(n) && op.Op != patchOpAdd) {
+			t.Fatalf("índice %q no válido en %s", tok, op.Path)
+		}
+		if !last {
+			n[i] = applyOp(t, n[i], tokens[1:], op)
+			return n
+		}
+		switch op.Op {
+		case patchOpAdd:
+			n = append(n[:i], append([]any{op.Value}, n[i:]...)...)
+		case patchOpReplace:
+			n[i] = op.Value
+		case patchOpRemove:
+			n = append(n[:i], n[i+1:]...)
+		}
+		return n
+	}
+	t.Fatalf("%s no apunta a un objeto ni a un array", op.Path)
+	return nil
+}
+
+func TestDiffJSONRoundTrip(t *testing.T) {
+	cases := []struct {
+		name     string
+		from, to any
+	}{
+		{"iguales", map[string]any{"a": 1}, map[string]any{"a": 1}},
+		{"mapas anidados", map[string]any{
+			"players": map[string]any{"0": map[string]any{"name": "Ana", "total": 100}},
+			"old":     true,
+		}, map[string]any{
+			"players": map[string]any{"0": map[string]any{"name": "Ana", "total": 350}, "1": map[string]any{"name": "Luis"}},
+			"new":     "x",
+		}},
+		{"array que crece", map[string]any{"dice": []any{1, 2}}, map[string]any{"dice": []any{1, 3, 4, 5}}},
+		{"array que encoge", map[string]any{"dice": []any{1, 2, 3, 4}}, map[string]any{"dice": []any{2}}},
+		{"array de objetos", []any{map[string]any{"held": false}, map[string]any{"held": true}}, []any{map[string]any{"held": true}}},
+		{"null a array", map[string]any{"selectedIndices": nil}, map[string]any{"selectedIndices": []any{0, 2}}},
+		{"array a null", map[string]any{"selectedIndices": []any{0, 2}}, map[string]any{"selectedIndices": nil}},
+		{"claves con / y ~", map[string]any{"a/b": 1, "c~d": 2, "~1": 3}, map[string]any{"a/b": 2, "~1": 4, "e/~f": 5}},
+		{"cambio de tipo en la raíz", map[string]any{"a": 1}, []any{1}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			from, err := normalizeJSON(tc.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			to, err := normalizeJSON(tc.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ops := diffJSON(from, to)
+			// La base se normaliza de nuevo porque applyPatch la modifica
+			base, _ := normalizeJSON(tc.from)
+			if got := applyPatch(t, base, ops); !reflect.DeepEqual(got, to) {
+				t.Errorf("parche %+v\nda %#v\nse esperaba %#v", ops, got, to)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitDefault es la clave de Cfg.MessageRateLimits que se aplica a los
+// tipos de mensaje sin límite propio (todos comparten el mismo bucket).
+const rateLimitDefault = "default"
+
+// rateLimitJoinProbe es la etiqueta de rateLimitedTotal de los joins frenados
+// por fallar demasiados códigos de partida.
+const rateLimitJoinProbe = "join_probe"
+
+// rateLimitListGames es la etiqueta de rateLimitedTotal de las consultas a
+// GET /games frenadas por IP.
+const rateLimitListGames = "list_games_ip"
+
+// rateLimit configura un token bucket: Rate tokens por segundo, hasta Burst.
+type rateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// parseRateLimit interpreta "rate/burst", p. ej. "0.5/3".
+func parseRateLimit(s string) (rateLimit, error) {
+	rate, burst, ok := strings.Cut(s, "/")
+	if !ok {
+		return rateLimit{}, fmt.Errorf("se esperaba rate/burst")
+	}
+	r, err := strconv.ParseFloat(strings.TrimSpace(rate), 64)
+	if err != nil || r < 0 {
+		return rateLimit{}, fmt.Errorf("rate inválido %q", rate)
+	}
+	b, err := strconv.Atoi(strings.TrimSpace(burst))
+	if err != nil || b < 1 {
+		return rateLimit{}, fmt.Errorf("burst inválido %q", burst)
+	}
+	return rateLimit{Rate: r, Burst: b}, nil
+}
+
+type tokenBucket struct {
+	limit  rateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit rateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.Rate)
+	}
+	b.last = now
+}
+
+// allow consume un token si hay disponible. Si no, devuelve cuánto falta para
+// el siguiente.
+func (b *tokenBucket) allow(now time.Time) (bool, time.Duration) {
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, b.wait(now)
+}
+
+// wait devuelve cuánto falta para que haya un token disponible (0 si ya lo hay)
+// sin consumirlo.
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	if b.limit.Rate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// full indica si el bucket se ha recargado por completo (nadie lo está usando).
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= float64(b.limit.Burst)
+}
+
+// keyedRateLimiter mantiene un token bucket por clave (p. ej. por IP).
+type keyedRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func (l *keyedRateLimiter) allow(key string, limit rateLimit, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newTokenBucket(limit, now)
+		l.buckets[key] = b
+	}
+	return b.allow(now)
+}
+
+// prune elimina los buckets llenos, que ya no limitan a nadie.
+func (l *keyedRateLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if b.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// allowMessage aplica los límites de mensajes de la conexión y, para create,
+// el límite de partidas creadas por IP. Si el mensaje se descarta, devuelve
+// también cuánto falta para que se admita. Solo la usa la goroutine de readPump.
+func (c *Client) allowMessage(msgType string) (bool, time.Duration) {
+	now := time.Now()
+	key := msgType
+	limit, ok := Cfg.MessageRateLimits[key]
+	if !ok {
+		key = rateLimitDefault
+		limit = Cfg.MessageRateLimits[key]
+	}
+
+	if c.limits == nil {
+		c.limits = make(map[string]*tokenBucket)
+	}
+	b, ok := c.limits[key]
+	if !ok {
+		b = newTokenBucket(limit, now)
+		c.limits[key] = b
+	}
+	allowed, wait := b.allow(now)
+	if allowed && msgType == msgCreate {
+		key = "create_ip"
+		allowed, wait = c.hub.createLimiter.allow(c.ip, Cfg.CreateRatePerIP, now)
+	}
+	if !allowed {
+		rateLimitedTotal.WithLabelValues(key).Inc()
+	}
+	return allowed, wait
+}
+
+// sendRateLimited responde a un mensaje descartado por los límites con un
+// error tipado RATE_LIMITED. No se guarda en la caché de requestId para que el
+// reintento se procese cuando haya tokens.
+func (c *Client) sendRateLimited(msg InMessage, retryAfter time.Duration) {
+	payload := map[string]any{
+		jsonKeyType:    msgError,
+		jsonKeyCode:    errCodeRateLimited,
+		jsonKeyMsg:     errRateLimited,
+		"retryAfterMs": retryAfter.Milliseconds(),
+	}
+	if msg.RequestID != "" {
+		payload[jsonKeyRequest] = msg.RequestID
+	}
+	c.rateLimited = true
+	c.sendJSON(payload)
+}
@@ -0,0 +1,83 @@
+package main
+
+// handleSpectate conecta al cliente a una partida como espectador: recibe el
+// estado y los eventos de la partida, pero no puede jugar. Como en join, hace
+// falta la contraseña de la sala y, si la partida lo admite, sale de la cola y
+// de la partida en la que esté.
+func (c *Client) handleSpectate(msg InMessage) {
+	g := c.findGame(msg)
+	if g == nil {
+		return
+	}
+
+	c.hub.matchmaker.dequeue(c, queueLeft)
+	previous := c.game.Load()
+
+	watching := false
+	if !g.call(func() { watching = g.handleSpectate(c, msg) }) {
+		c.sendError(errGameNotFound)
+		return
+	}
+	if !watching {
+		return
+	}
+	c.game.Store(g)
+	if previous != nil && previous != g {
+		c.leave(previous)
+	}
+}
+
+func (g *Game) handleSpectate(c *Client, msg InMessage) bool {
+	if g.seatOf(c) >= 0 || g.spectators[c] {
+		c.sendError(errAlreadyInGame)
+		return false
+	}
+	if !g.allowSpectators {
+		c.sendError(errNoSpectators)
+		return false
+	}
+	if g.isBanned(c) {
+		c.sendError(errBanned)
+		return false
+	}
+	password := ""
+	if msg.Password != nil {
+		password = *msg.Password
+	}
+	if !g.checkJoinPassword(c, password) {
+		return false
+	}
+
+	g.spectators[c] = true
+	delete(g.stateAcks, c)
+	c.sendJSON(map[string]any{
+		jsonKeyType:     msgSpectating,
+		jsonKeyGameCode: g.code,
+	})
+	// El recuento de espectadores forma parte del estado
+	g.broadcastState()
+	g.sendChatHistory(c)
+	return true
+}
+
+// removeSpectator desconecta a un espectador de la partida. Devuelve false si
+// el cliente no era espectador.
+func (g *Game) removeSpectator(c *Client) bool {
+	if !g.spectators[c] {
+		return false
+	}
+	delete(g.spectators, c)
+	delete(g.stateAcks, c)
+	g.broadcastState()
+	return true
+}
+
+// sendNotSeated responde a una acción de un cliente sin asiento: los
+// espectadores no pueden jugar y el resto no está en la partida.
+func (g *Game) sendNotSeated(c *Client) {
+	if g.spectators[c] {
+		c.sendError(errSpectator)
+		return
+	}
+	c.sendError(errNoGame)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"reflect"
+)
+
+// stateSnapshot es una versión ya emitida del estado de la partida, guardada
+// en forma JSON genérica para poder calcular parches contra ella.
+type stateSnapshot struct {
+	version int
+	doc     any
+}
+
+// snapshotState devuelve la versión actual del estado de la partida.
+// Si el estado ha cambiado desde la última versión registrada, crea una nueva
+// versión y la guarda en el historial (acotado a Cfg.StateHistorySize).
+func (g *Game) snapshotState() (int, any, error) {
+	doc, err := normalizeJSON(g.stateDocument())
+	if err != nil {
+		return 0, nil, err
+	}
+	if n := len(g.stateHistory); n > 0 && reflect.DeepEqual(g.stateHistory[n-1].doc, doc) {
+		return g.stateHistory[n-1].version, doc, nil
+	}
+
+	g.stateVersion++
+	g.stateHistory = append(g.stateHistory, stateSnapshot{version: g.stateVersion, doc: doc})
+	if over := len(g.stateHistory) - Cfg.StateHistorySize; over > 0 {
+		g.stateHistory = append(g.stateHistory[:0], g.stateHistory[over:]...)
+	}
+	return g.stateVersion, doc, nil
+}
+
+// stateAt devuelve el documento de una versión del historial, si sigue guardada.
+func (g *Game) stateAt(version int) (any, bool) {
+	for _, s := range g.stateHistory {
+		if s.version == version {
+			return s.doc, true
+		}
+	}
+	return nil, false
+}
+
+// stateMessage serializa el mensaje de estado para un cliente que ha
+// confirmado baseVersion: un parche si la base sigue en el historial y el
+// parche es más pequeño, o el estado completo en cualquier otro caso.
+func (g *Game) stateMessage(baseVersion, version int, doc any) []byte {
+	full := fullStateMessage(version, doc)
+	if baseVersion <= 0 {
+		return full
+	}
+	base, ok := g.stateAt(baseVersion)
+	if !ok {
+		return full
+	}
+
+	patch, err := json.Marshal(map[string]any{
+		jsonKeyType:   msgGameStatePatch,
+		"baseVersion": baseVersion,
+		"version":     version,
+		"patch":       diffJSON(base, doc),
+	})
+	if err != nil || len(patch) >= len(full) {
+		return full
+	}
+	return patch
+}
+
+func fullStateMessage(version int, doc any) []byte {
+	state := map[string]any{jsonKeyType: msgGameState, "version": version}
+	if m, ok := doc.(map[string]any); ok {
+		for k, v := range m {
+			state[k] = v
+		}
+	}
+	data, _ := json.Marshal(state)
+	return data
+}
+
+// handleStateAck registra la última versión de game_state que el cliente ha
+// aplicado. A partir de ese momento recibe parches contra esa versión.
+func (g *Game) handleStateAck(c *Client, msg InMessage) {
+	if g.seatOf(c) < 0 && !g.spectators[c] {
+		c.sendError(errNoGame)
+		return
+	}
+	if msg.Version <= 0 || msg.Version > g.stateVersion {
+		c.sendError(errInvalidVersion)
+		return
+	}
+	g.stateAcks[c] = msg.Version
+}
+
+// handleGetState envía al cliente el estado completo actual y descarta su
+// versión confirmada, de modo que los siguientes parches partan de este estado
+// una vez lo confirme.
+func (g *Game) handleGetState(c *Client) {
+	if g.seatOf(c) < 0 && !g.spectators[c] {
+		c.sendError(errNoGame)
+		return
+	}
+	version, doc, err := g.snapshotState()
+	if err != nil {
+		log.Println("No se pudo serializar el estado de la partida:", err)
+		return
+	}
+	delete(g.stateAcks, c)
+	c.sendState(fullStateMessage(version, doc))
+}
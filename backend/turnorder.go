@@ -0,0 +1,135 @@
+package main
+
+import "math/rand"
+
+// Modos de orden de turnos al empezar (campo turnOrder de start)
+const (
+	turnOrderFixed   = "fixed"   // el orden de los asientos, que el anfitrión puede cambiar
+	turnOrderShuffle = "shuffle" // orden aleatorio
+	turnOrderRollOff = "rolloff" // cada jugador tira un dado y empieza el más alto
+)
+
+// identityTurnOrder devuelve el orden de turnos por defecto: el de los asientos.
+func identityTurnOrder(n int) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	return order
+}
+
+// seatedTurnOrder devuelve los asientos ocupados en orden de turno.
+func (g *Game) seatedTurnOrder() []int {
+	order := make([]int, 0, len(g.turnOrder))
+	for _, seat := range g.turnOrder {
+		if g.clients[seat] != nil {
+			order = append(order, seat)
+		}
+	}
+	return order
+}
+
+// handleReorderSeats permite al anfitrión cambiar el orden de turnos en el
+// lobby. msg.Values lista asientos en el orden deseado; los que no aparecen
+// van detrás, en el orden que ya tenían.
+func (g *Game) handleReorderSeats(c *Client, msg InMessage) {
+	seat := g.seatOf(c)
+	if seat < 0 {
+		g.sendNotSeated(c)
+		return
+	}
+	if seat != g.host {
+		c.sendError("Only the creator can reorder seats")
+		return
+	}
+	if g.gameStarted {
+		c.sendError(errGameAlreadyStarted)
+		return
+	}
+
+	listed := make([]bool, len(g.clients))
+	order := make([]int, 0, len(g.clients))
+	for _, s := range msg.Values {
+		if s < 0 || s >= len(g.clients) || listed[s] {
+			c.sendError(errInvalidIndex)
+			return
+		}
+		listed[s] = true
+		order = append(order, s)
+	}
+	for _, s := range g.turnOrder {
+		if !listed[s] {
+			order = append(order, s)
+		}
+	}
+	g.turnOrder = order
+	g.broadcastState()
+}
+
+// applyTurnOrder fija el orden de turnos al empezar la partida según mode.
+// Devuelve false si mode no es válido.
+func (g *Game) applyTurnOrder(mode string) bool {
+	switch mode {
+	case "", turnOrderFixed:
+	case turnOrderShuffle:
+		rand.Shuffle(len(g.turnOrder), func(i, j int) {
+			g.turnOrder[i], g.turnOrder[j] = g.turnOrder[j], g.turnOrder[i]
+		})
+	case turnOrderRollOff:
+		first, rounds := g.rollOff()
+		g.rotateTurnOrder(first)
+		g.broadcast(map[string]any{
+			jsonKeyType:   msgRollOff,
+			"rounds":      rounds,
+			jsonKeyWinner: first,
+		})
+	default:
+		return false
+	}
+	g.currentPlayerIndex = g.nextActivePlayerIndex(invalidIndex)
+	if g.currentPlayerIndex < 0 {
+		g.currentPlayerIndex = 0
+	}
+	return true
+}
+
+// rollOff hace que cada jugador sentado tire un dado; los empatados en la
+// tirada más alta vuelven a tirar hasta que solo queda uno. Devuelve el
+// asiento ganador y las tiradas de cada ronda (asiento -> valor).
+func (g *Game) rollOff() (int, []map[int]int) {
+	contenders := g.seatedTurnOrder()
+	var rounds []map[int]int
+	for len(contenders) > 1 {
+		rolls := make(map[int]int, len(contenders))
+		best := 0
+		for _, seat := range contenders {
+			v := rand.Intn(6) + 1
+			rolls[seat] = v
+			best = max(best, v)
+		}
+		rounds = append(rounds, rolls)
+
+		next := contenders[:0]
+		for _, seat := range contenders {
+			if rolls[seat] == best {
+				next = append(next, seat)
+			}
+		}
+		contenders = next
+	}
+	if len(contenders) == 0 {
+		return invalidIndex, rounds
+	}
+	return contenders[0], rounds
+}
+
+// rotateTurnOrder rota el orden de turnos para que empiece first, sin cambiar
+// el orden relativo del resto.
+func (g *Game) rotateTurnOrder(first int) {
+	for i, seat := range g.turnOrder {
+		if seat == first {
+			g.turnOrder = append(g.turnOrder[i:], g.turnOrder[:i]...)
+			return
+		}
+	}
+}
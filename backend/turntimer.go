@@ -0,0 +1,171 @@
+package main
+
+import "time"
+
+// Comportamiento al vencer el tiempo de un turno
+const (
+	turnExpiryAuto    = "auto"    // se planta si ya ha apartado dados en esta tirada; si no, pierde el turno
+	turnExpiryForfeit = "forfeit" // pierde siempre los puntos del turno
+)
+
+// Valores de la etiqueta outcome de turnTimeoutsTotal
+const (
+	turnTimeoutBanked    = "banked"
+	turnTimeoutForfeited = "forfeited"
+	turnTimeoutOutOfTime = "out_of_time"
+)
+
+// maxTimerSeconds acota el tiempo por turno y el del reloj de ajedrez.
+const maxTimerSeconds = 24 * 60 * 60
+
+// validTurnTimer comprueba las opciones de tiempo de create y update_config.
+func validTurnTimer(msg InMessage) bool {
+	for _, secs := range []*int{msg.TurnSeconds, msg.ClockSeconds} {
+		if secs != nil && (*secs < 0 || *secs > maxTimerSeconds) {
+			return false
+		}
+	}
+	switch msg.TurnExpiry {
+	case "", turnExpiryAuto, turnExpiryForfeit:
+		return true
+	}
+	return false
+}
+
+// setTurnTimer aplica las opciones de tiempo de msg, ya validadas con
+// validTurnTimer. Las que no vienen en el mensaje no cambian.
+func (g *Game) setTurnTimer(msg InMessage) {
+	if msg.TurnSeconds != nil {
+		g.turnLimit = time.Duration(*msg.TurnSeconds) * time.Second
+	}
+	if msg.ClockSeconds != nil {
+		g.clockLimit = time.Duration(*msg.ClockSeconds) * time.Second
+	}
+	if msg.TurnExpiry != "" {
+		g.turnExpiry = msg.TurnExpiry
+	}
+}
+
+// resetClocks llena el reloj de todos los jugadores al empezar la partida.
+func (g *Game) resetClocks() {
+	for i := range g.clocks {
+		g.clocks[i] = g.clockLimit
+		g.outOfTime[i] = false
+	}
+}
+
+// startTurnTimer empieza a contar el turno del jugador actual, parando antes
+// el temporizador del turno anterior. El turno vence al agotar el tiempo por
+// turno o, en modo reloj de ajedrez, el reloj del jugador si se agota antes.
+// No hace nada si la partida no está en juego o no tiene límites de tiempo.
+func (g *Game) startTurnTimer() {
+	g.stopTurnTimer()
+	seat := g.currentPlayerIndex
+	if !g.gameStarted || g.winnerIndex >= 0 || seat < 0 || seat >= len(g.clients) {
+		return
+	}
+	if g.turnLimit <= 0 && g.clockLimit <= 0 {
+		return
+	}
+
+	limit := g.turnLimit
+	if g.clockLimit > 0 && (limit <= 0 || g.clocks[seat] < limit) {
+		limit = g.clocks[seat]
+	}
+	now := time.Now()
+	g.turnTimerSeat = seat
+	g.turnStartedAt = now
+	g.turnDeadline = now.Add(limit)
+	seq := g.turnTimerSeq
+	g.turnTimer = time.AfterFunc(limit, func() {
+		g.do(func() {
+			// Si el turno terminó mientras el vencimiento esperaba en la cola, se ignora
+			if g.turnTimerSeq == seq {
+				g.expireTurn()
+			}
+		})
+	})
+}
+
+// stopTurnTimer para el temporizador del turno en curso y descuenta del reloj
+// del jugador el tiempo que ha usado.
+func (g *Game) stopTurnTimer() {
+	if g.turnTimer == nil {
+		return
+	}
+	g.turnTimer.Stop()
+	g.turnTimer = nil
+	g.turnTimerSeq++
+	g.turnDeadline = time.Time{}
+	if g.clockLimit > 0 {
+		g.clocks[g.turnTimerSeat] = max(g.clocks[g.turnTimerSeat]-time.Since(g.turnStartedAt), 0)
+	}
+}
+
+// expireTurn termina el turno del jugador actual cuando se le acaba el tiempo.
+// Si ha agotado su reloj de ajedrez, pierde la partida; si no, se planta o
+// pierde los puntos del turno según turnExpiry.
+func (g *Game) expireTurn() {
+	seat := g.turnTimerSeat
+	g.stopTurnTimer()
+	if g.winnerIndex >= 0 || seat != g.currentPlayerIndex {
+		return
+	}
+	if g.clockLimit > 0 && g.clocks[seat] <= 0 {
+		turnTimeoutsTotal.WithLabelValues(turnTimeoutOutOfTime).Inc()
+		g.flagPlayer(seat)
+		return
+	}
+
+	g.recordTimeout(seat)
+	banked := g.turnExpiry == turnExpiryAuto && g.hasApartadoThisRoll && g.turnPoints > 0
+	g.broadcast(map[string]any{
+		jsonKeyType:   msgTurnTimeout,
+		jsonKeyMsg:    "Se ha acabado el tiempo del turno",
+		"playerIndex": seat,
+		"banked":      banked,
+	})
+	if banked {
+		turnTimeoutsTotal.WithLabelValues(turnTimeoutBanked).Inc()
+		g.bankTurn(seat)
+		return
+	}
+
+	turnTimeoutsTotal.WithLabelValues(turnTimeoutForfeited).Inc()
+	if g.passTurn(seat) {
+		g.broadcast(map[string]any{jsonKeyType: msgGameOver, jsonKeyWinner: g.winnerIndex, jsonKeyMsg: "Partida terminada"})
+	}
+	g.broadcastState()
+}
+
+// flagPlayer deja fuera de la partida al jugador que ha agotado su reloj. Si
+// solo queda un jugador en juego, ese jugador gana.
+func (g *Game) flagPlayer(seat int) {
+	g.outOfTime[seat] = true
+	g.broadcast(map[string]any{
+		jsonKeyType:   msgOutOfTime,
+		jsonKeyMsg:    g.playerNames[seat] + " se ha quedado sin tiempo",
+		"playerIndex": seat,
+	})
+
+	remaining := make([]int, 0, len(g.clients))
+	for i := range g.clients {
+		if g.contending(i) {
+			remaining = append(remaining, i)
+		}
+	}
+	if len(remaining) == 1 {
+		g.resetTurn()
+		g.winnerIndex = remaining[0]
+		g.finishedAt = time.Now()
+		g.appendFinishedGameToHistory()
+		g.broadcast(map[string]any{jsonKeyType: msgGameOver, jsonKeyWinner: g.winnerIndex, jsonKeyMsg: "Partida terminada"})
+		g.broadcastState()
+		return
+	}
+
+	if g.passTurn(seat) {
+		g.broadcast(map[string]any{jsonKeyType: msgGameOver, jsonKeyWinner: g.winnerIndex, jsonKeyMsg: "Partida terminada"})
+	}
+	g.broadcastState()
+}
@@ -0,0 +1,65 @@
+package main
+
+// setAsideUndo guarda el estado del turno justo antes de un set_aside, para
+// poder deshacerlo con undo_set_aside hasta la siguiente tirada.
+type setAsideUndo struct {
+	dice                 []Die
+	selectedIndices      []int
+	turnPoints           int
+	turnMoves            int // número de movimientos del turno
+	hasApartadoThisRoll  bool
+	hotDiceCountThisTurn int
+	lastHotDiceBonus     int
+}
+
+// pushSetAsideUndo apila el estado actual del turno antes de apartar dados.
+func (g *Game) pushSetAsideUndo() {
+	g.undoStack = append(g.undoStack, setAsideUndo{
+		dice:                 append([]Die(nil), g.dice...),
+		selectedIndices:      append([]int(nil), g.selectedIndices...),
+		turnPoints:           g.turnPoints,
+		turnMoves:            len(g.turnMoves),
+		hasApartadoThisRoll:  g.hasApartadoThisRoll,
+		hotDiceCountThisTurn: g.hotDiceCountThisTurn,
+		lastHotDiceBonus:     g.lastHotDiceBonus,
+	})
+}
+
+// handleUndoSetAside deshace el último set_aside de la tirada actual: los
+// dados vuelven a estar sin apartar (y seleccionados), y se quitan sus puntos
+// y el bonus de mano limpia si se aplicó.
+func (g *Game) handleUndoSetAside(c *Client) {
+	seat := g.seatOf(c)
+	if seat < 0 {
+		g.sendNotSeated(c)
+		return
+	}
+
+	if !g.gameStarted {
+		c.sendError(errGameNotStarted)
+		return
+	}
+	if g.winnerIndex >= 0 {
+		c.sendError(errGameFinished)
+		return
+	}
+	if g.currentPlayerIndex != seat {
+		c.sendError(errNotYourTurn)
+		return
+	}
+	if len(g.undoStack) == 0 {
+		c.sendError(errNothingToUndo)
+		return
+	}
+
+	last := g.undoStack[len(g.undoStack)-1]
+	g.undoStack = g.undoStack[:len(g.undoStack)-1]
+	g.dice = last.dice
+	g.selectedIndices = last.selectedIndices
+	g.turnPoints = last.turnPoints
+	g.turnMoves = g.turnMoves[:last.turnMoves]
+	g.hasApartadoThisRoll = last.hasApartadoThisRoll
+	g.hotDiceCountThisTurn = last.hotDiceCountThisTurn
+	g.lastHotDiceBonus = last.lastHotDiceBonus
+	g.broadcastState()
+}
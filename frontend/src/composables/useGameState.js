@@ -19,6 +19,7 @@ import { game as msg } from '@/messages.js';
 export function useGameState(myPlayerIndex) {
   const players = ref(INITIAL_PLAYERS.map((p) => ({ ...p, active: true })));
   const currentPlayerIndex = ref(0);
+  const hostIndex = ref(0);
   const victoryScore = ref(2000);
   const winnerIndex = ref(null);
   const finalRoundTriggerIndex = ref(null);
@@ -61,6 +62,7 @@ export function useGameState(myPlayerIndex) {
     }));
 
     currentPlayerIndex.value = data.currentPlayerIndex ?? 0;
+    hostIndex.value = data.hostIndex ?? 0;
     victoryScore.value = data.victoryScore ?? 2000;
     winnerIndex.value = data.winnerIndex >= 0 ? data.winnerIndex : null;
     finalRoundTriggerIndex.value = data.finalRoundTriggerIndex >= 0 ? data.finalRoundTriggerIndex : null;
@@ -133,6 +135,7 @@ export function useGameState(myPlayerIndex) {
     isRolling.value = false;
     players.value = INITIAL_PLAYERS.map((p) => ({ ...p, active: true }));
     currentPlayerIndex.value = 0;
+    hostIndex.value = 0;
     winnerIndex.value = null;
     turnPoints.value = 0;
     turnMoves.value = [];
@@ -152,6 +155,7 @@ export function useGameState(myPlayerIndex) {
   return {
     players,
     currentPlayerIndex,
+    hostIndex,
     victoryScore,
     winnerIndex,
     finalRoundTriggerIndex,
@@ -54,6 +54,7 @@ export const MSG_SEND = {
   START: 'start',
   UPDATE_CONFIG: 'update_config',
   RESTART: 'restart',
+  READY: 'ready',
 };
 
 // ─── Tipos de mensajes WebSocket (lobby) ────────────────────────────────────
@@ -94,4 +94,7 @@ export const lobby = {
   joining: 'Joining…',
   join: 'Join',
   gameSettings: 'Game settings',
+  ready: 'Ready',
+  imReady: "I'm ready",
+  notReady: 'Not ready',
 };